@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 
 	"github.com/gorilla/mux"
 	"github.com/mitchellh/mapstructure"
@@ -27,8 +28,9 @@ func unmarshalBody(req *http.Request, target interface{}) (httpErr *HttpError) {
 	bodyBytes, err := ioutil.ReadAll(io.LimitReader(req.Body, 1048576))
 	if err != nil {
 		httpErr = RequestUnmarshallError
-	}
-	if err = json.Unmarshal(bodyBytes, target); err != nil {
+	} else if len(bodyBytes) == 0 {
+		return
+	} else if err = json.Unmarshal(bodyBytes, target); err != nil {
 		httpErr = BodyUnmarshallError
 	}
 	return
@@ -38,13 +40,15 @@ func buildRoute(m *MinihyperProxy, referenceObject interface{}, routeFunction Ro
 
 		var httpErr *HttpError
 		var obj, response interface{}
+		// Decode into a fresh value, referenceObject is shared by all requests.
+		request := reflect.New(reflect.TypeOf(referenceObject)).Elem().Interface()
 
 		defer throwError(resp, m, &httpErr)
 		resp.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 		if httpErr = unmarshalBody(req, &obj); httpErr == nil {
-			if err := mapstructure.Decode(obj, &referenceObject); err == nil {
-				if response, httpErr = routeFunction(referenceObject, m); httpErr == nil {
+			if err := mapstructure.Decode(obj, &request); err == nil {
+				if response, httpErr = routeFunction(request, m); httpErr == nil {
 					json.NewEncoder(resp).Encode(response)
 				}
 			} else {
@@ -68,6 +72,30 @@ func getServer(getServerRequest interface{}, m *MinihyperProxy) (response interf
 	return
 }
 
+func stopServer(stopServerRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := stopServerRequest.(GetServerRequest)
+	if httpErr = m.stopServer(obj.Name); httpErr == nil {
+		response, httpErr = getServer(obj, m)
+	}
+	return
+}
+
+func startServer(startServerRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := startServerRequest.(GetServerRequest)
+	if httpErr = m.startServer(obj.Name); httpErr == nil {
+		response, httpErr = getServer(obj, m)
+	}
+	return
+}
+
+func restartServer(restartServerRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := restartServerRequest.(GetServerRequest)
+	if httpErr = m.restartServer(obj.Name); httpErr == nil {
+		response, httpErr = getServer(obj, m)
+	}
+	return
+}
+
 func getProxies(getProxiesRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
 	serversInfo := m.GetProxiesInfo()
 	response = ListServersResponse{Info: serversInfo}
@@ -84,27 +112,41 @@ func getProxy(getProxyRequest interface{}, m *MinihyperProxy) (response interfac
 func getProxyMap(getProxyMapRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
 	obj := getProxyMapRequest.(GetServerRequest)
 	if proxyMap, httpErr := m.GetProxyMap(obj.Name); httpErr == nil {
-		response = ProxyMapResponse{ProxyMap: proxyMap}
+		routes, _ := m.GetRoutes(obj.Name)
+		response = ProxyMapResponse{ProxyMap: proxyMap, Routes: routes}
+	}
+	return
+}
+func getProxyHealth(getProxyHealthRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := getProxyHealthRequest.(GetServerRequest)
+	var health map[string][]UpstreamStats
+	if health, httpErr = m.GetHealth(obj.Name); httpErr == nil {
+		response = HealthResponse{Health: health}
+	}
+	return
+}
+func setProxyTLS(setTLSRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := setTLSRequest.(SetTLSRequest)
+	var certificates []CertificateInfo
+	if certificates, httpErr = m.SetTLS(obj.Name, obj.TLSOptions); httpErr == nil {
+		response = SetTLSResponse{Name: obj.Name, Certificates: certificates}
 	}
 	return
 }
 func createProxy(createProxyRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
 	obj := createProxyRequest.(CreateProxyRequest)
-	if name, hostname, httpErr := m.startProxyServer(obj.Name, obj.Hostname); httpErr == nil {
-		response = CreateProxyResponse{Name: obj.Name, Hostname: hostname, Port: name}
+	var port, hostname string
+	if port, hostname, httpErr = m.startProxyServer(obj.Name, obj.Hostname, obj.Port, obj.ServerOptions); httpErr == nil {
+		response = CreateProxyResponse{Name: obj.Name, Hostname: hostname, Port: port}
 	}
 	return
 }
 
 func createRoute(createRouteRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
 	obj := createRouteRequest.(CreateRouteRequest)
-	if routeURL, err := url.Parse(obj.Route); err == nil {
-		if targetURL, err := url.Parse(obj.Target); err == nil {
-			if httpErr = m.addProxyRedirect(obj.Name, routeURL, targetURL); httpErr == nil {
-				response = obj
-			}
-		} else {
-			httpErr = URLParsingError
+	if targetURL, err := parseTarget(obj.Target); err == nil {
+		if httpErr = m.addProxyRedirect(obj.Name, obj.Route, targetURL, obj.RouteOptions); httpErr == nil {
+			response = obj
 		}
 	} else {
 		httpErr = URLParsingError
@@ -128,8 +170,9 @@ func getHopper(getHopperRequest interface{}, m *MinihyperProxy) (response interf
 
 func createHopper(createHopperRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
 	obj := createHopperRequest.(CreateHopperRequest)
-	if incomingport, outgoingport, hostname, httpErr := m.startHopperServer(obj.Name, obj.Hostname); httpErr == nil {
-		response = CreateHopperResponse{Name: obj.Name, Hostname: hostname, IncomingPort: incomingport, OutgoingPort: outgoingport}
+	var incomingPort, outgoingPort, hostname string
+	if incomingPort, outgoingPort, hostname, httpErr = m.startHopperServer(obj.Name, obj.Hostname, obj.IncomingPort, obj.OutgoingPort, obj.ServerOptions); httpErr == nil {
+		response = CreateHopperResponse{Name: obj.Name, Hostname: hostname, IncomingPort: incomingPort, OutgoingPort: outgoingPort}
 	}
 
 	return
@@ -139,7 +182,8 @@ func getHops(getHopsRequest interface{}, m *MinihyperProxy) (response interface{
 	obj := getHopsRequest.(GetHopsRequest)
 	if incomingHops, httpErr := m.GetIncomingHops(obj.Name); httpErr == nil {
 		if outgoingHops, httpErr := m.GetOutgoingHops(obj.Name); httpErr == nil {
-			response = GetHopsResponse{IncomingHops: incomingHops, OutgoingHops: outgoingHops}
+			breakers, _ := m.GetHopBreakers(obj.Name)
+			response = GetHopsResponse{IncomingHops: incomingHops, OutgoingHops: outgoingHops, Breakers: breakers}
 		}
 	}
 	return
@@ -178,10 +222,10 @@ func createIncomingHop(createIncomingHopRequest interface{}, m *MinihyperProxy)
 }
 
 func createOutgoingHop(createOutgoingHopRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
-	obj := createOutgoingHopRequest.(CreateIncomingHopRequest)
+	obj := createOutgoingHopRequest.(CreateOutgoingHopRequest)
 	if routeURL, err := url.Parse(obj.Route); err == nil {
 		if targetURL, err := url.Parse(obj.Target); err == nil {
-			if httpErr = m.ReceiveHop(obj.Name, routeURL, targetURL); httpErr == nil {
+			if httpErr = m.AddHop(obj.Name, routeURL, targetURL, obj.HopOptions); httpErr == nil {
 				response = obj
 			}
 		} else {
@@ -193,6 +237,84 @@ func createOutgoingHop(createOutgoingHopRequest interface{}, m *MinihyperProxy)
 	return
 }
 
+func deleteProxy(deleteProxyRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := deleteProxyRequest.(GetServerRequest)
+	if httpErr = m.deleteServer(obj.Name, "Proxy"); httpErr == nil {
+		response = obj
+	}
+	return
+}
+
+func deleteRoute(deleteRouteRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := deleteRouteRequest.(DeleteRouteRequest)
+	if httpErr = m.removeProxyRedirect(obj.Name, obj.Route, obj.RouteConditions); httpErr == nil {
+		response = obj
+	}
+	return
+}
+
+func deleteHopper(deleteHopperRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := deleteHopperRequest.(GetServerRequest)
+	if httpErr = m.deleteServer(obj.Name, "Hopper"); httpErr == nil {
+		response = obj
+	}
+	return
+}
+
+func deleteIncomingHop(deleteIncomingHopRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := deleteIncomingHopRequest.(DeleteHopRequest)
+	if routeURL, err := url.Parse(obj.Route); err == nil {
+		if httpErr = m.RemoveReceivedHop(obj.Name, routeURL); httpErr == nil {
+			response = obj
+		}
+	} else {
+		httpErr = URLParsingError
+	}
+	return
+}
+
+func deleteOutgoingHop(deleteOutgoingHopRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := deleteOutgoingHopRequest.(DeleteHopRequest)
+	if routeURL, err := url.Parse(obj.Route); err == nil {
+		if httpErr = m.RemoveHop(obj.Name, routeURL); httpErr == nil {
+			response = obj
+		}
+	} else {
+		httpErr = URLParsingError
+	}
+	return
+}
+
+func exportConfig(exportConfigRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	response = m.ExportConfig()
+	return
+}
+
+func getConfigReload(getConfigReloadRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	if lastReload := m.LastReload(); lastReload == nil {
+		httpErr = NoReloadError
+	} else {
+		response = lastReload
+	}
+	return
+}
+
+func reloadConfig(reloadConfigRequest interface{}, m *MinihyperProxy) (response interface{}, httpErr *HttpError) {
+	obj := reloadConfigRequest.(ReloadConfigRequest)
+	path := obj.Path
+	if path == "" {
+		path = m.ConfigPath()
+	}
+	if path == "" {
+		httpErr = EmptyFieldError
+	} else if diff, err := m.ReloadConfig(path); err != nil {
+		httpErr = &HttpError{ErrString: err.Error(), code: 422}
+	} else {
+		response = diff
+	}
+	return
+}
+
 func BuildAPI(m *MinihyperProxy) *mux.Router {
 
 	m.InfoLog.Printf("Initializing API")
@@ -200,23 +322,37 @@ func BuildAPI(m *MinihyperProxy) *mux.Router {
 	httpMux := mux.NewRouter().StrictSlash(true)
 	httpMux.HandleFunc("/servers", buildRoute(m, EmptyRequest{}, getServers)).Methods("GET")
 	httpMux.HandleFunc("/server", buildRoute(m, GetServerRequest{}, getServer)).Methods("GET")
+	httpMux.HandleFunc("/server/stop", buildRoute(m, GetServerRequest{}, stopServer)).Methods("POST")
+	httpMux.HandleFunc("/server/start", buildRoute(m, GetServerRequest{}, startServer)).Methods("POST")
+	httpMux.HandleFunc("/server/restart", buildRoute(m, GetServerRequest{}, restartServer)).Methods("POST")
+
+	httpMux.HandleFunc("/config", buildRoute(m, EmptyRequest{}, exportConfig)).Methods("GET")
+	httpMux.HandleFunc("/config/reload", buildRoute(m, EmptyRequest{}, getConfigReload)).Methods("GET")
+	httpMux.HandleFunc("/config/reload", buildRoute(m, ReloadConfigRequest{}, reloadConfig)).Methods("POST")
 
 	httpMux.HandleFunc("/proxies", buildRoute(m, EmptyRequest{}, getProxies)).Methods("GET")
 	httpMux.HandleFunc("/proxy", buildRoute(m, CreateProxyRequest{}, createProxy)).Methods("POST")
 	httpMux.HandleFunc("/proxy", buildRoute(m, GetServerRequest{}, getProxy)).Methods("GET")
+	httpMux.HandleFunc("/proxy", buildRoute(m, GetServerRequest{}, deleteProxy)).Methods("DELETE")
 
 	httpMux.HandleFunc("/proxy/route", buildRoute(m, GetServerRequest{}, getProxyMap)).Methods("GET")
 	httpMux.HandleFunc("/proxy/route", buildRoute(m, CreateRouteRequest{}, createRoute)).Methods("POST")
+	httpMux.HandleFunc("/proxy/route", buildRoute(m, DeleteRouteRequest{}, deleteRoute)).Methods("DELETE")
+	httpMux.HandleFunc("/proxy/health", buildRoute(m, GetServerRequest{}, getProxyHealth)).Methods("GET")
+	httpMux.HandleFunc("/proxy/tls", buildRoute(m, SetTLSRequest{}, setProxyTLS)).Methods("POST")
 
 	httpMux.HandleFunc("/hoppers", buildRoute(m, EmptyRequest{}, getHoppers)).Methods("GET")
 	httpMux.HandleFunc("/hopper", buildRoute(m, CreateHopperRequest{}, createHopper)).Methods("POST")
 	httpMux.HandleFunc("/hopper", buildRoute(m, GetServerRequest{}, getHopper)).Methods("GET")
+	httpMux.HandleFunc("/hopper", buildRoute(m, GetServerRequest{}, deleteHopper)).Methods("DELETE")
 
 	httpMux.HandleFunc("/hopper/hop", buildRoute(m, GetHopsRequest{}, getHops)).Methods("GET")
 	httpMux.HandleFunc("/hopper/hop/out", buildRoute(m, GetHopsRequest{}, getOutgoingHops)).Methods("GET")
 	httpMux.HandleFunc("/hopper/hop/in", buildRoute(m, GetHopsRequest{}, getIncomingHops)).Methods("GET")
 	httpMux.HandleFunc("/hopper/hop/out", buildRoute(m, CreateOutgoingHopRequest{}, createOutgoingHop)).Methods("POST")
 	httpMux.HandleFunc("/hopper/hop/in", buildRoute(m, CreateIncomingHopRequest{}, createIncomingHop)).Methods("POST")
+	httpMux.HandleFunc("/hopper/hop/out", buildRoute(m, DeleteHopRequest{}, deleteOutgoingHop)).Methods("DELETE")
+	httpMux.HandleFunc("/hopper/hop/in", buildRoute(m, DeleteHopRequest{}, deleteIncomingHop)).Methods("DELETE")
 
 	return httpMux
 }
@@ -0,0 +1,196 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func callAPI(t *testing.T, api http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	api.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestDeleteEndpoints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("create proxy: %d %s", resp.Code, resp.Body)
+	}
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	proxyURL := "http://localhost:" + created.Port
+
+	callAPI(t, api, "POST", "/proxy/route", `{"Name": "api", "Route": "/users", "Target": "`+upstream.URL+`"}`)
+	time.Sleep(100 * time.Millisecond)
+	if r, err := http.Get(proxyURL + "/users"); err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("route not served before delete: %v %v", r, err)
+	}
+
+	if resp := callAPI(t, api, "DELETE", "/proxy/route", `{"Name": "api", "Route": "/users"}`); resp.Code != http.StatusOK {
+		t.Fatalf("delete route: %d %s", resp.Code, resp.Body)
+	}
+	if r, err := http.Get(proxyURL + "/users"); err != nil || r.StatusCode != http.StatusNotFound {
+		t.Fatalf("route still served after delete: %v %v", r, err)
+	}
+	if resp := callAPI(t, api, "DELETE", "/proxy/route", `{"Name": "api", "Route": "/users"}`); resp.Code != http.StatusNotFound {
+		t.Errorf("deleting a missing route: expected 404, got %d", resp.Code)
+	}
+
+	if resp := callAPI(t, api, "DELETE", "/hopper", `{"Name": "api"}`); resp.Code != WrongServerTypeError.code {
+		t.Errorf("deleting a proxy as a hopper: expected %d, got %d", WrongServerTypeError.code, resp.Code)
+	}
+	if resp := callAPI(t, api, "DELETE", "/proxy", `{"Name": "api"}`); resp.Code != http.StatusOK {
+		t.Fatalf("delete proxy: %d %s", resp.Code, resp.Body)
+	}
+	if _, ok := m.Servers["api"]; ok {
+		t.Error("api still registered after delete")
+	}
+	if m.Ports.IsReserved("localhost", created.Port) {
+		t.Error("host:port still reserved after delete")
+	}
+	listener, err := net.Listen("tcp", "localhost:"+created.Port)
+	if err != nil {
+		t.Fatalf("port not freed: %v", err)
+	}
+	listener.Close()
+
+	callAPI(t, api, "POST", "/hopper", `{"Name": "edge"}`)
+	callAPI(t, api, "POST", "/hopper/hop/out", `{"Name": "edge", "Route": "http://www.example.com", "Target": "http://localhost:7100"}`)
+	callAPI(t, api, "POST", "/hopper/hop/in", `{"Name": "edge", "Route": "http://www.example.org", "Target": "http://localhost:7100"}`)
+	if resp := callAPI(t, api, "DELETE", "/hopper/hop/out", `{"Name": "edge", "Route": "http://www.example.com"}`); resp.Code != http.StatusOK {
+		t.Errorf("delete outgoing hop: %d %s", resp.Code, resp.Body)
+	}
+	if resp := callAPI(t, api, "DELETE", "/hopper/hop/in", `{"Name": "edge", "Route": "http://www.example.org"}`); resp.Code != http.StatusOK {
+		t.Errorf("delete incoming hop: %d %s", resp.Code, resp.Body)
+	}
+	if hops, _ := m.GetOutgoingHops("edge"); len(hops) != 0 {
+		t.Errorf("outgoing hops left: %v", hops)
+	}
+	if hops, _ := m.GetIncomingHops("edge"); len(hops) != 0 {
+		t.Errorf("incoming hops left: %v", hops)
+	}
+	if resp := callAPI(t, api, "DELETE", "/hopper", `{"Name": "edge"}`); resp.Code != http.StatusOK {
+		t.Fatalf("delete hopper: %d %s", resp.Code, resp.Body)
+	}
+	if len(m.Servers) != 0 {
+		t.Errorf("servers left: %v", m.Servers)
+	}
+}
+
+func serverStatus(t *testing.T, resp *httptest.ResponseRecorder) string {
+	listed := ListServersResponse{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &listed); err != nil || len(listed.Info) != 1 {
+		t.Fatalf("unexpected server response %d %s", resp.Code, resp.Body)
+	}
+	return (*listed.Info[0])["Status"].(string)
+}
+
+func TestServerLifecycle(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+	callAPI(t, api, "POST", "/proxy/route", `{"Name": "api", "Route": "/users", "Target": "`+upstream.URL+`"}`)
+	proxyURL := "http://localhost:" + created.Port + "/users"
+
+	if status := serverStatus(t, callAPI(t, api, "POST", "/server/stop", `{"Name": "api"}`)); status != StatusDown {
+		t.Fatalf("expected Down after stop, got %s", status)
+	}
+	if _, err := http.Get(proxyURL); err == nil {
+		t.Fatal("stopped server still answers")
+	}
+	if resp := callAPI(t, api, "POST", "/server/stop", `{"Name": "api"}`); resp.Code != ServerAlreadyStoppedError.code {
+		t.Errorf("stopping twice: expected %d, got %d", ServerAlreadyStoppedError.code, resp.Code)
+	}
+
+	for _, action := range []string{"start", "restart"} {
+		if status := serverStatus(t, callAPI(t, api, "POST", "/server/"+action, `{"Name": "api"}`)); status != StatusUp {
+			t.Fatalf("expected Up after %s, got %s", action, status)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if r, err := http.Get(proxyURL); err != nil || r.StatusCode != http.StatusOK {
+			t.Fatalf("route lost after %s: %v %v", action, r, err)
+		}
+	}
+	if resp := callAPI(t, api, "POST", "/server/start", `{"Name": "api"}`); resp.Code != ServerAlreadyRunningError.code {
+		t.Errorf("starting twice: expected %d, got %d", ServerAlreadyRunningError.code, resp.Code)
+	}
+}
+
+func TestCreateProxyBindError(t *testing.T) {
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api", "Port": "`+port+`"}`)
+	if resp.Code != http.StatusInternalServerError || !strings.Contains(resp.Body.String(), "address already in use") {
+		t.Fatalf("expected bind error, got %d %s", resp.Code, resp.Body)
+	}
+	if _, ok := m.Servers["api"]; ok {
+		t.Error("server that failed to bind is still registered")
+	}
+}
+
+func TestExportConfigRedactsKeys(t *testing.T) {
+	cert, key := newTestCertificate(t, "a.test")
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+
+	tlsOptions := &TLSOptions{Certificates: []TLSCertificate{{CertPEM: cert, KeyPEM: key}}}
+	if _, _, httpErr := m.startProxyServer("secure", "", "", ServerOptions{TLS: tlsOptions}); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("secure")
+	upstream := &UpstreamOptions{TLS: &UpstreamTLS{Certificate: &TLSCertificate{CertPEM: cert, KeyPEM: key}}}
+	m.addProxyRedirect("secure", "/users", &url.URL{Scheme: "https", Host: "localhost:9000"}, RouteOptions{Upstream: upstream})
+	if _, _, _, httpErr := m.startHopperServer("edge", "", "", "", ServerOptions{HopSigning: &HopSigning{SharedKey: "s3cret"}}); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("edge")
+
+	resp := callAPI(t, api, "GET", "/config", "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", resp.Code, resp.Body)
+	}
+	body := resp.Body.String()
+	// The first line of the key body is enough to tell it apart.
+	for _, secret := range []string{strings.Split(key, "\n")[1], "s3cret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("exported config leaks %q", secret)
+		}
+	}
+	if !strings.Contains(body, "REDACTED") {
+		t.Errorf("expected the keys to be redacted in %s", body)
+	}
+	if snapshot := m.snapshotConfig(); snapshot.Proxies[0].TLS.Certificates[0].KeyPEM != key || snapshot.Hoppers[0].HopSigning.SharedKey != "s3cret" {
+		t.Errorf("the snapshot for the store lost the keys")
+	}
+}
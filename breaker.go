@@ -0,0 +1,222 @@
+package minihyperproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "Closed"
+	BreakerOpen     = "Open"
+	BreakerHalfOpen = "HalfOpen"
+)
+
+// CircuitBreaker opens once MinRequests requests were seen within Window and
+// ErrorRate percent of them failed with a 5xx or a connection error, or
+// SlowCallRate percent of them took SlowCallDuration or more. An open breaker
+// answers Status and Body without forwarding anything for CoolDown, then lets
+// HalfOpenRequests requests through: it closes again if they all succeed and
+// opens again otherwise.
+type CircuitBreaker struct {
+	ErrorRate        float64 `json:"ErrorRate,omitempty" yaml:"ErrorRate,omitempty"`
+	SlowCallRate     float64 `json:"SlowCallRate,omitempty" yaml:"SlowCallRate,omitempty"`
+	SlowCallDuration string  `json:"SlowCallDuration,omitempty" yaml:"SlowCallDuration,omitempty"`
+	MinRequests      int     `json:"MinRequests,omitempty" yaml:"MinRequests,omitempty"`
+	Window           string  `json:"Window,omitempty" yaml:"Window,omitempty"`
+	CoolDown         string  `json:"CoolDown,omitempty" yaml:"CoolDown,omitempty"`
+	HalfOpenRequests int     `json:"HalfOpenRequests,omitempty" yaml:"HalfOpenRequests,omitempty"`
+	Status           int     `json:"Status,omitempty" yaml:"Status,omitempty"`
+	Body             string  `json:"Body,omitempty" yaml:"Body,omitempty"`
+}
+
+type BreakerStats struct {
+	State     string `json:"State"`
+	Requests  int    `json:"Requests"`
+	Failures  int    `json:"Failures"`
+	SlowCalls int    `json:"SlowCalls"`
+	Opens     uint64 `json:"Opens"`
+}
+
+type breaker struct {
+	errorRate        float64
+	slowCallRate     float64
+	slowCallDuration time.Duration
+	minRequests      int
+	window           time.Duration
+	coolDown         time.Duration
+	halfOpenRequests int
+	status           int
+	body             string
+
+	lock        sync.Mutex
+	state       string
+	windowStart time.Time
+	openedAt    time.Time
+	requests    int
+	failures    int
+	slowCalls   int
+	probes      int
+	successes   int
+	opens       uint64
+}
+
+func (c *CircuitBreaker) newBreaker() (b *breaker, err error) {
+	b = &breaker{errorRate: c.ErrorRate, slowCallRate: c.SlowCallRate,
+		minRequests:      orDefault(c.MinRequests, 10),
+		halfOpenRequests: orDefault(c.HalfOpenRequests, 1),
+		status:           orDefault(c.Status, http.StatusServiceUnavailable),
+		body:             c.Body,
+		state:            BreakerClosed,
+		windowStart:      time.Now()}
+	if b.errorRate == 0 {
+		b.errorRate = 50
+	}
+	if b.errorRate < 0 || b.errorRate > 100 || b.slowCallRate < 0 || b.slowCallRate > 100 {
+		return nil, fmt.Errorf("breaker rates must be percentages")
+	}
+	if b.minRequests < 1 || b.halfOpenRequests < 1 {
+		return nil, fmt.Errorf("MinRequests and HalfOpenRequests must be positive")
+	}
+	if b.status < 100 || b.status > 599 {
+		return nil, fmt.Errorf("invalid breaker Status %d", b.status)
+	}
+	if b.body == "" {
+		b.body = fmt.Sprintf("%d - Circuit breaker open", b.status)
+	}
+	if b.slowCallDuration, err = parseDuration("SlowCallDuration", c.SlowCallDuration, 0); err != nil {
+		return nil, err
+	}
+	if b.slowCallRate > 0 && b.slowCallDuration == 0 {
+		return nil, fmt.Errorf("SlowCallRate needs a SlowCallDuration")
+	}
+	if b.window, err = parseDuration("Window", c.Window, 10*time.Second); err != nil {
+		return nil, err
+	}
+	if b.coolDown, err = parseDuration("CoolDown", c.CoolDown, 30*time.Second); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// allow tells whether a request may go through, and answers it with the
+// breaker status and body otherwise.
+func (b *breaker) allow(w http.ResponseWriter) bool {
+	b.lock.Lock()
+	now := time.Now()
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.coolDown {
+		b.state, b.probes, b.successes = BreakerHalfOpen, 0, 0
+	}
+	allowed := true
+	switch b.state {
+	case BreakerOpen:
+		allowed = false
+	case BreakerHalfOpen:
+		if allowed = b.probes < b.halfOpenRequests; allowed {
+			b.probes++
+		}
+	default:
+		if now.Sub(b.windowStart) >= b.window {
+			b.reset(now)
+		}
+	}
+	b.lock.Unlock()
+	if !allowed {
+		w.WriteHeader(b.status)
+		w.Write([]byte(b.body))
+	}
+	return allowed
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.windowStart, b.requests, b.failures, b.slowCalls = now, 0, 0, 0
+}
+
+// record feeds the outcome of a request allowed through to the breaker.
+func (b *breaker) record(failed bool, latency time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	slow := b.slowCallDuration > 0 && latency >= b.slowCallDuration
+	now := time.Now()
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed || slow {
+			b.open(now)
+		} else if b.successes++; b.successes >= b.halfOpenRequests {
+			b.state = BreakerClosed
+			b.reset(now)
+		}
+	case BreakerClosed:
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slowCalls++
+		}
+		if b.requests >= b.minRequests && (float64(b.failures*100) >= b.errorRate*float64(b.requests) ||
+			(b.slowCallRate > 0 && float64(b.slowCalls*100) >= b.slowCallRate*float64(b.requests))) {
+			b.open(now)
+		}
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state, b.openedAt = BreakerOpen, now
+	b.opens++
+	b.reset(now)
+}
+
+func (b *breaker) stats() *BreakerStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state := b.state
+	if state == BreakerOpen && time.Since(b.openedAt) >= b.coolDown {
+		state = BreakerHalfOpen
+	}
+	return &BreakerStats{State: state, Requests: b.requests, Failures: b.failures, SlowCalls: b.slowCalls, Opens: b.opens}
+}
+
+// statusRecorder remembers the status written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := r.ResponseWriter.(http.Hijacker); ok {
+		if r.status == 0 {
+			r.status = http.StatusSwitchingProtocols
+		}
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T does not support hijacking", r.ResponseWriter)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,156 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerStates(t *testing.T) {
+	b, err := (&CircuitBreaker{SlowCallRate: 50, SlowCallDuration: "10ms", MinRequests: 2, CoolDown: "20ms", HalfOpenRequests: 2}).newBreaker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := func() bool { return b.allow(httptest.NewRecorder()) }
+
+	allow()
+	b.record(false, time.Millisecond)
+	allow()
+	b.record(false, 20*time.Millisecond)
+	if b.stats().State != BreakerOpen || allow() {
+		t.Fatalf("breaker not opened by slow calls: %+v", b.stats())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !allow() || !allow() || allow() {
+		t.Errorf("half-open breaker should let exactly 2 requests through")
+	}
+	b.record(false, time.Millisecond)
+	b.record(true, time.Millisecond)
+	if stats := b.stats(); stats.State != BreakerOpen || stats.Opens != 2 {
+		t.Errorf("failed probe should open the breaker again: %+v", stats)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	allow()
+	allow()
+	b.record(false, time.Millisecond)
+	b.record(false, time.Millisecond)
+	if b.stats().State != BreakerClosed || !allow() {
+		t.Errorf("successful probes should close the breaker: %+v", b.stats())
+	}
+
+	for _, c := range []CircuitBreaker{{ErrorRate: 120}, {SlowCallRate: 10}, {Status: 42}, {CoolDown: "soon"}} {
+		if _, err := c.newBreaker(); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+func TestRouteBreaker(t *testing.T) {
+	var failing int32 = 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	body := `{"Name": "api", "Route": "/svc", "Target": "` + upstream.URL + `", "Breaker": {"MinRequests": 3, "CoolDown": "50ms", "Status": 429, "Body": "shed"}}`
+	if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+		t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+	}
+
+	proxyURL := "http://localhost:" + created.Port + "/svc"
+	for i := 0; i < 3; i++ {
+		if status, _ := getBody(t, proxyURL); status != http.StatusInternalServerError {
+			t.Errorf("expected the upstream 500 while closed, got %d", status)
+		}
+	}
+	if status, body := getBody(t, proxyURL); status != 429 || body != "shed" {
+		t.Errorf("open breaker: expected 429 shed, got %d %s", status, body)
+	}
+	listed := ProxyMapResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy/route", `{"Name": "api"}`).Body.Bytes(), &listed)
+	if len(listed.Routes) != 1 || listed.Routes[0].BreakerState == nil || listed.Routes[0].BreakerState.State != BreakerOpen {
+		t.Fatalf("breaker state not listed: %+v", listed.Routes)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	if status, body := getBody(t, proxyURL); status != http.StatusOK || body != "ok" {
+		t.Errorf("half-open probe: expected 200 ok, got %d %s", status, body)
+	}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy/route", `{"Name": "api"}`).Body.Bytes(), &listed)
+	if state := listed.Routes[0].BreakerState; state.State != BreakerClosed || state.Opens != 1 {
+		t.Errorf("breaker not closed after a successful probe: %+v", state)
+	}
+}
+
+func TestHopBreaker(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	_, outgoingPort, _, httpErr := m.startHopperServer("a", "", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("a")
+	incomingPort, _, _, httpErr := m.startHopperServer("b", "", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("b")
+	m.ReceiveHop("b", upstreamURL, upstreamURL)
+
+	body := `{"Name": "a", "Route": "` + upstream.URL + `", "Target": "http://localhost:` + incomingPort + `", "Breaker": {"MinRequests": 2, "CoolDown": "1m"}}`
+	if resp := callAPI(t, api, "POST", "/hopper/hop/out", body); resp.Code != http.StatusOK {
+		t.Fatalf("create hop: %d %s", resp.Code, resp.Body)
+	}
+	if resp := callAPI(t, api, "POST", "/hopper/hop/out", `{"Name": "a", "Route": "http://other", "Target": "http://localhost:1", "Breaker": {"Window": "-1s"}}`); resp.Code != 422 {
+		t.Errorf("invalid breaker: expected 422, got %d", resp.Code)
+	}
+
+	hopURL := "http://localhost:" + outgoingPort + "/" + upstreamURL.Hostname() + "/"
+	for i := 0; i < 4; i++ {
+		getBody(t, hopURL)
+	}
+	if status, body := getBody(t, hopURL); status != http.StatusServiceUnavailable || body != "503 - Circuit breaker open" || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("open hop breaker: got %d %s after %d calls", status, body, atomic.LoadInt32(&calls))
+	}
+
+	hops := GetHopsResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/hopper/hop", `{"Name": "a"}`).Body.Bytes(), &hops)
+	if state := hops.Breakers[upstreamURL.Hostname()]; state == nil || state.State != BreakerOpen || state.Opens != 1 {
+		t.Errorf("hop breaker state not listed: %+v", hops.Breakers)
+	}
+	if exported := m.ExportConfig(); len(exported.Hoppers) == 0 {
+		t.Errorf("nothing exported")
+	} else {
+		for _, h := range exported.Hoppers {
+			if h.Name == "a" && (len(h.OutgoingHops) != 1 || h.OutgoingHops[0].Breaker == nil) {
+				t.Errorf("hop breaker not exported: %+v", h.OutgoingHops)
+			}
+		}
+	}
+}
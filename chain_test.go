@@ -0,0 +1,129 @@
+package minihyperproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// startHoppers starts a hopper per name, returning the ports of their
+// incoming and outgoing hop proxies.
+func startHoppers(t *testing.T, m *MinihyperProxy, names ...string) (incoming map[string]string, outgoing map[string]string) {
+	incoming, outgoing = make(map[string]string), make(map[string]string)
+	for _, name := range names {
+		incomingPort, outgoingPort, _, httpErr := m.startHopperServer(name, "", "", "", ServerOptions{})
+		if httpErr != nil {
+			t.Fatalf("start %s: %v", name, httpErr)
+		}
+		incoming[name], outgoing[name] = incomingPort, outgoingPort
+	}
+	return
+}
+
+func TestMultiHopChains(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-MHP-Hop-Path") + " " + r.URL.RequestURI() + " " + r.Header.Get("X-MHP-Hop-Route")))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	m := NewMinihyperProxy()
+	names := []string{"a", "b", "c", "d", "e"}
+	incoming, outgoing := startHoppers(t, m, names...)
+	for _, name := range names {
+		defer m.removeServer(name)
+	}
+	hopURL := func(name string) string { return "http://localhost:" + incoming[name] }
+	for _, name := range []string{"b", "c", "d", "e"} {
+		m.ReceiveHop(name, upstreamURL, upstreamURL)
+	}
+
+	get := func(name string) (int, string, string) {
+		req, _ := http.NewRequest("GET", "http://localhost:"+outgoing[name]+"/"+upstreamURL.Hostname()+"/deep/path?q=1", nil)
+		req.Header.Set("X-MHP-Hop-Path", "forged")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp.Header.Get("X-MHP-Hop-Path")
+	}
+
+	// An explicit path, a -> b -> c -> d -> target.
+	hop, _ := url.Parse(hopURL("b"))
+	if httpErr := m.AddHop("a", upstreamURL, hop, HopOptions{Via: []string{hopURL("c"), hopURL("d")}}); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	if status, body, path := get("a"); status != http.StatusOK || body != "a,b,c,d /deep/path?q=1 " || path != "a,b,c,d" {
+		t.Errorf("explicit chain: got %d %q, traced %q", status, body, path)
+	}
+
+	// A path continued by the outgoing hops of each hopper, e -> c -> d -> target.
+	hop, _ = url.Parse(hopURL("c"))
+	m.AddHop("e", upstreamURL, hop, HopOptions{})
+	hop, _ = url.Parse(hopURL("d"))
+	m.AddHop("c", upstreamURL, hop, HopOptions{})
+	if status, body, path := get("e"); status != http.StatusOK || body != "e,c,d /deep/path?q=1 " || path != "e,c,d" {
+		t.Errorf("chain of outgoing hops: got %d %q, traced %q", status, body, path)
+	}
+
+	// Every hopper on the path must have received the target.
+	m.RemoveReceivedHop("d", upstreamURL)
+	if status, _, _ := get("a"); status != http.StatusInternalServerError {
+		t.Errorf("chain through a hopper without the target: expected 500, got %d", status)
+	}
+
+	hop, _ = url.Parse(hopURL("b"))
+	if httpErr := m.AddHop("a", upstreamURL, hop, HopOptions{Via: []string{"localhost:1"}}); httpErr == nil || httpErr.code != 422 {
+		t.Errorf("invalid Via: expected 422, got %v", httpErr)
+	}
+}
+
+func TestHopLoops(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-MHP-Hop-TTL")))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	m := NewMinihyperProxy()
+	incoming, outgoing := startHoppers(t, m, "a", "b", "c", "d")
+	for name := range incoming {
+		defer m.removeServer(name)
+		m.ReceiveHop(name, upstreamURL, upstreamURL)
+	}
+	edgeIncoming, edgeOutgoing, _, httpErr := m.startHopperServer("edge", "", "", "", ServerOptions{MaxHops: 3})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("edge")
+	incoming["edge"], outgoing["edge"] = edgeIncoming, edgeOutgoing
+	hopURL := func(name string) *url.URL { return &url.URL{Scheme: "http", Host: "localhost:" + incoming[name]} }
+	get := func(name string) (int, string) {
+		return getBody(t, "http://localhost:"+outgoing[name]+"/"+upstreamURL.Hostname()+"/")
+	}
+
+	m.AddHop("edge", upstreamURL, hopURL("a"), HopOptions{Via: []string{hopURL("b").String()}})
+	if status, body := get("edge"); status != http.StatusOK || body != "0" {
+		t.Errorf("chain within MaxHops: expected 200 with no hops left, got %d %s", status, body)
+	}
+	m.AddHop("edge", upstreamURL, hopURL("a"), HopOptions{Via: []string{hopURL("b").String(), hopURL("c").String()}})
+	if status, body := get("edge"); status != http.StatusLoopDetected || body != "508 - Loop detected: request ran out of hops at c, path edge,a,b,c" {
+		t.Errorf("chain beyond MaxHops: got %d %s", status, body)
+	}
+
+	m.AddHop("d", upstreamURL, hopURL("d"), HopOptions{})
+	if status, body := get("d"); status != http.StatusLoopDetected || body != "508 - Loop detected: request already went through d, path d,d" {
+		t.Errorf("hop to itself: got %d %s", status, body)
+	}
+
+	m.AddHop("a", upstreamURL, hopURL("b"), HopOptions{})
+	m.AddHop("b", upstreamURL, hopURL("c"), HopOptions{})
+	m.AddHop("c", upstreamURL, hopURL("a"), HopOptions{})
+	if status, body := get("a"); status != http.StatusLoopDetected || body != "508 - Loop detected: request already went through a, path a,b,c,a" {
+		t.Errorf("loop between hoppers: got %d %s", status, body)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/edo3/minihyperproxy"
 	"github.com/gorilla/mux"
@@ -13,7 +16,20 @@ func handleRequests(httpMux *mux.Router) {
 }
 
 func main() {
+	configPath := flag.String("config", os.Getenv("MHP_CONFIG"), "path to a JSON or YAML config file (env MHP_CONFIG)")
+	flag.Parse()
+
 	mini := minihyperproxy.NewMinihyperProxy()
+	// Reloads would overwrite the restored state with the file, so the file is
+	// only watched when it was imported.
+	if *configPath != "" && len(mini.Servers) > 0 {
+		mini.WarnLog.Printf("State restored from MHP_STATE_DIR, ignoring config file %s", *configPath)
+	} else if *configPath != "" {
+		if err := mini.ImportConfig(*configPath); err != nil {
+			mini.ErrorLog.Fatal(err)
+		}
+		mini.WatchConfig(*configPath, 2*time.Second)
+	}
 	httpMux := minihyperproxy.BuildAPI(mini)
 	mini.InfoLog.Printf("Serving MiniHyperProxy on port: %v", 7052)
 	handleRequests(httpMux)
@@ -0,0 +1,138 @@
+package minihyperproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrentAPIAndTraffic mutates routes, hops and servers through the
+// API while requests flow through a proxy and a pair of hoppers. Run it with
+// -race.
+func TestConcurrentAPIAndTraffic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+
+	proxyPort, _, httpErr := m.startProxyServer("api", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("api")
+	m.addProxyRedirect("api", "/stable", upstreamURL, RouteOptions{})
+
+	_, outgoingPort, _, httpErr := m.startHopperServer("a", "", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("a")
+	incomingPort, _, _, httpErr := m.startHopperServer("b", "", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("b")
+	m.AddHop("a", upstreamURL, &url.URL{Scheme: "http", Host: "localhost:" + incomingPort}, HopOptions{})
+	m.ReceiveHop("b", upstreamURL, upstreamURL)
+
+	stableURLs := []string{
+		"http://localhost:" + proxyPort + "/stable",
+		"http://localhost:" + outgoingPort + "/" + upstreamURL.Hostname() + "/stable",
+	}
+
+	done := make(chan struct{})
+	var failures int32
+	var requests int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				resp, err := http.Get(target)
+				if err != nil {
+					atomic.AddInt32(&failures, 1)
+					t.Errorf("GET %s: %v", target, err)
+					return
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || string(body) != "upstream" {
+					atomic.AddInt32(&failures, 1)
+					t.Errorf("GET %s: %d %s", target, resp.StatusCode, body)
+					return
+				}
+				atomic.AddInt32(&requests, 1)
+			}
+		}(stableURLs[i%len(stableURLs)])
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				route := fmt.Sprintf("/w%d/r%d", worker, n%5)
+				host := fmt.Sprintf("http://w%d-h%d.example.com", worker, n%5)
+				callAPI(t, api, "POST", "/proxy/route", `{"Name": "api", "Route": "`+route+`", "Target": "`+upstream.URL+`"}`)
+				callAPI(t, api, "POST", "/hopper/hop/out", `{"Name": "a", "Route": "`+host+`", "Target": "http://localhost:`+incomingPort+`"}`)
+				callAPI(t, api, "POST", "/hopper/hop/in", `{"Name": "b", "Route": "`+host+`", "Target": "`+host+`"}`)
+				callAPI(t, api, "GET", "/servers", "")
+				callAPI(t, api, "GET", "/config", "")
+				callAPI(t, api, "GET", "/proxy/route", `{"Name": "api"}`)
+				callAPI(t, api, "GET", "/hopper/hop", `{"Name": "a"}`)
+				callAPI(t, api, "DELETE", "/proxy/route", `{"Name": "api", "Route": "`+route+`"}`)
+				callAPI(t, api, "DELETE", "/hopper/hop/out", `{"Name": "a", "Route": "`+host+`"}`)
+				callAPI(t, api, "DELETE", "/hopper/hop/in", `{"Name": "b", "Route": "`+host+`"}`)
+			}
+		}(i)
+	}
+
+	// Racing creations of the same name must leave exactly one winner.
+	var created int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := callAPI(t, api, "POST", "/proxy", `{"Name": "contended"}`); resp.Code == http.StatusOK {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+
+	time.Sleep(time.Second)
+	close(done)
+	wg.Wait()
+
+	if created != 1 {
+		t.Errorf("expected one proxy named contended, %d were created", created)
+	}
+	m.removeServer("contended")
+	if failures == 0 && requests == 0 {
+		t.Error("no request went through")
+	}
+	if routes, _ := m.GetProxyMap("api"); len(routes) != 1 {
+		t.Errorf("expected only the stable route left, got %v", routes)
+	}
+}
@@ -0,0 +1,448 @@
+package minihyperproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Proxies []ProxyConfig  `json:"Proxies,omitempty" yaml:"Proxies,omitempty"`
+	Hoppers []HopperConfig `json:"Hoppers,omitempty" yaml:"Hoppers,omitempty"`
+}
+
+type ProxyConfig struct {
+	Name          string        `json:"Name" yaml:"Name"`
+	Hostname      string        `json:"Hostname,omitempty" yaml:"Hostname,omitempty"`
+	Port          string        `json:"Port,omitempty" yaml:"Port,omitempty"`
+	Routes        []RouteConfig `json:"Routes,omitempty" yaml:"Routes,omitempty"`
+	Stopped       bool          `json:"Stopped,omitempty" yaml:"Stopped,omitempty"`
+	ServerOptions `yaml:",inline"`
+	line          int
+}
+
+type RouteConfig struct {
+	Route        string `json:"Route" yaml:"Route"`
+	Target       string `json:"Target" yaml:"Target"`
+	RouteOptions `yaml:",inline"`
+	line         int
+}
+
+type HopperConfig struct {
+	Name          string              `json:"Name" yaml:"Name"`
+	Hostname      string              `json:"Hostname,omitempty" yaml:"Hostname,omitempty"`
+	IncomingPort  string              `json:"IncomingPort,omitempty" yaml:"IncomingPort,omitempty"`
+	OutgoingPort  string              `json:"OutgoingPort,omitempty" yaml:"OutgoingPort,omitempty"`
+	OutgoingHops  []OutgoingHopConfig `json:"OutgoingHops,omitempty" yaml:"OutgoingHops,omitempty"`
+	IncomingHops  []IncomingHopConfig `json:"IncomingHops,omitempty" yaml:"IncomingHops,omitempty"`
+	Stopped       bool                `json:"Stopped,omitempty" yaml:"Stopped,omitempty"`
+	ServerOptions `yaml:",inline"`
+	line          int
+}
+
+type OutgoingHopConfig struct {
+	Target     string `json:"Target" yaml:"Target"`
+	Hop        string `json:"Hop" yaml:"Hop"`
+	HopOptions `yaml:",inline"`
+	line       int
+}
+
+type IncomingHopConfig struct {
+	Target string `json:"Target" yaml:"Target"`
+	line   int
+}
+
+// ConfigError points at the line of the config file that could not be loaded.
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	file := e.File
+	if file == "" {
+		file = "config"
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", file, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", file, e.Msg)
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+func yamlConfigError(file string, err error) *ConfigError {
+	msg := err.Error()
+	if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) > 0 {
+		msg = typeErr.Errors[0]
+	}
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	if match := yamlErrorLine.FindStringSubmatch(msg); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return &ConfigError{File: file, Line: line, Msg: match[2]}
+	}
+	return &ConfigError{File: file, Msg: msg}
+}
+
+// ParseConfig reads a JSON or YAML config document and validates it.
+func ParseConfig(file string, data []byte) (config *Config, err error) {
+	config = &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, yamlConfigError(file, err)
+	}
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err == nil {
+		config.setLines(&root)
+	}
+	if err = config.validate(file); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func yamlSequence(mapping *yaml.Node, key string) []*yaml.Node {
+	if mapping.Kind == yaml.DocumentNode && len(mapping.Content) > 0 {
+		mapping = mapping.Content[0]
+	}
+	if mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key && mapping.Content[i+1].Kind == yaml.SequenceNode {
+			return mapping.Content[i+1].Content
+		}
+	}
+	return nil
+}
+
+// setLines records the line every entry was declared on so that validation
+// errors can point back at it.
+func (c *Config) setLines(root *yaml.Node) {
+	proxies := yamlSequence(root, "Proxies")
+	for i := range c.Proxies {
+		if i >= len(proxies) {
+			break
+		}
+		c.Proxies[i].line = proxies[i].Line
+		routes := yamlSequence(proxies[i], "Routes")
+		for j := range c.Proxies[i].Routes {
+			if j < len(routes) {
+				c.Proxies[i].Routes[j].line = routes[j].Line
+			}
+		}
+	}
+
+	hoppers := yamlSequence(root, "Hoppers")
+	for i := range c.Hoppers {
+		if i >= len(hoppers) {
+			break
+		}
+		c.Hoppers[i].line = hoppers[i].Line
+		outgoing := yamlSequence(hoppers[i], "OutgoingHops")
+		for j := range c.Hoppers[i].OutgoingHops {
+			if j < len(outgoing) {
+				c.Hoppers[i].OutgoingHops[j].line = outgoing[j].Line
+			}
+		}
+		incoming := yamlSequence(hoppers[i], "IncomingHops")
+		for j := range c.Hoppers[i].IncomingHops {
+			if j < len(incoming) {
+				c.Hoppers[i].IncomingHops[j].line = incoming[j].Line
+			}
+		}
+	}
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &ConfigError{File: path, Msg: err.Error()}
+	}
+	return ParseConfig(path, data)
+}
+
+func validateURL(rawURL string, requireHost bool) error {
+	if rawURL == "" {
+		return fmt.Errorf("required field is empty")
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if requireHost && (parsed.Scheme == "" || parsed.Host == "") {
+		return fmt.Errorf("%q must be an absolute URL with scheme and host", rawURL)
+	}
+	return nil
+}
+
+func validatePort(port string) error {
+	if port == "" {
+		return nil
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return fmt.Errorf("%q is not a port number", port)
+	}
+	return nil
+}
+
+func (c *Config) validate(file string) error {
+	names := make(map[string]int)
+	checkName := func(name string, line int) *ConfigError {
+		if name == "" {
+			return &ConfigError{File: file, Line: line, Msg: "server Name is empty"}
+		}
+		if previous, ok := names[name]; ok {
+			return &ConfigError{File: file, Line: line, Msg: fmt.Sprintf("server %q already declared at line %d", name, previous)}
+		}
+		names[name] = line
+		return nil
+	}
+
+	for _, p := range c.Proxies {
+		if err := checkName(p.Name, p.line); err != nil {
+			return err
+		}
+		if err := validatePort(p.Port); err != nil {
+			return &ConfigError{File: file, Line: p.line, Msg: "invalid Port: " + err.Error()}
+		}
+		if _, err := p.ServerOptions.settings(); err != nil {
+			return &ConfigError{File: file, Line: p.line, Msg: err.Error()}
+		}
+		if err := p.ServerOptions.hopperOnly(); err != nil {
+			return &ConfigError{File: file, Line: p.line, Msg: err.Error()}
+		}
+		routes := make(map[string]int)
+		for _, r := range p.Routes {
+			if r.Target != "" || len(r.Targets) == 0 {
+				if err := validateURL(r.Target, true); err != nil {
+					return &ConfigError{File: file, Line: r.line, Msg: "invalid Target: " + err.Error()}
+				}
+			}
+			target, _ := parseTarget(r.Target)
+			if err := validateRoute(r.Route, target, r.RouteOptions); err != nil {
+				return &ConfigError{File: file, Line: r.line, Msg: err.Error()}
+			}
+			key := routeKey(r.Route, r.RouteConditions)
+			if previous, ok := routes[key]; ok {
+				return &ConfigError{File: file, Line: r.line, Msg: fmt.Sprintf("route %q already declared at line %d", key, previous)}
+			}
+			routes[key] = r.line
+		}
+	}
+
+	for _, h := range c.Hoppers {
+		if err := checkName(h.Name, h.line); err != nil {
+			return err
+		}
+		if err := validatePort(h.IncomingPort); err != nil {
+			return &ConfigError{File: file, Line: h.line, Msg: "invalid IncomingPort: " + err.Error()}
+		}
+		if err := validatePort(h.OutgoingPort); err != nil {
+			return &ConfigError{File: file, Line: h.line, Msg: "invalid OutgoingPort: " + err.Error()}
+		}
+		if h.IncomingPort != "" && h.IncomingPort == h.OutgoingPort {
+			return &ConfigError{File: file, Line: h.line, Msg: "IncomingPort and OutgoingPort must differ"}
+		}
+		if _, err := h.ServerOptions.settings(); err != nil {
+			return &ConfigError{File: file, Line: h.line, Msg: err.Error()}
+		}
+		if h.TLS != nil {
+			return &ConfigError{File: file, Line: h.line, Msg: errHopperTLS.Error()}
+		}
+		for _, o := range h.OutgoingHops {
+			if err := validateURL(o.Target, true); err != nil {
+				return &ConfigError{File: file, Line: o.line, Msg: "invalid Target: " + err.Error()}
+			}
+			if err := validateURL(o.Hop, true); err != nil {
+				return &ConfigError{File: file, Line: o.line, Msg: "invalid Hop: " + err.Error()}
+			}
+			if o.Breaker != nil {
+				if _, err := o.Breaker.newBreaker(); err != nil {
+					return &ConfigError{File: file, Line: o.line, Msg: "invalid Breaker: " + err.Error()}
+				}
+			}
+		}
+		for _, i := range h.IncomingHops {
+			if err := validateURL(i.Target, true); err != nil {
+				return &ConfigError{File: file, Line: i.line, Msg: "invalid Target: " + err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+// ImportConfig loads the config file at path and starts every server it
+// describes.
+func (m *MinihyperProxy) ImportConfig(path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	m.InfoLog.Printf("Importing config from %s", path)
+	return m.importConfig(path, config)
+}
+
+// importConfig starts the servers of config, removing those it started if
+// one of them fails, so that a config is never left half applied.
+func (m *MinihyperProxy) importConfig(file string, config *Config) (err error) {
+	var started []string
+	defer func() {
+		if err != nil {
+			for i := len(started) - 1; i >= 0; i-- {
+				m.removeServer(started[i])
+			}
+		}
+	}()
+
+	for _, p := range config.Proxies {
+		if _, _, httpErr := m.startProxyServer(p.Name, p.Hostname, p.Port, p.ServerOptions); httpErr != nil {
+			return &ConfigError{File: file, Line: p.line, Msg: httpErr.Error()}
+		}
+		started = append(started, p.Name)
+		for _, r := range p.Routes {
+			targetURL, _ := parseTarget(r.Target)
+			if httpErr := m.addProxyRedirect(p.Name, r.Route, targetURL, r.RouteOptions); httpErr != nil {
+				return &ConfigError{File: file, Line: r.line, Msg: httpErr.Error()}
+			}
+		}
+		if p.Stopped {
+			m.stopServer(p.Name)
+		}
+	}
+
+	for _, h := range config.Hoppers {
+		if _, _, _, httpErr := m.startHopperServer(h.Name, h.Hostname, h.IncomingPort, h.OutgoingPort, h.ServerOptions); httpErr != nil {
+			return &ConfigError{File: file, Line: h.line, Msg: httpErr.Error()}
+		}
+		started = append(started, h.Name)
+		for _, o := range h.OutgoingHops {
+			targetURL, _ := url.Parse(o.Target)
+			hopURL, _ := url.Parse(o.Hop)
+			if httpErr := m.addHop(h.Name, targetURL, hopURL, o.HopOptions, true); httpErr != nil {
+				return &ConfigError{File: file, Line: o.line, Msg: httpErr.Error()}
+			}
+		}
+		for _, i := range h.IncomingHops {
+			targetURL, _ := url.Parse(i.Target)
+			if httpErr := m.ReceiveHop(h.Name, targetURL, targetURL); httpErr != nil {
+				return &ConfigError{File: file, Line: i.line, Msg: httpErr.Error()}
+			}
+		}
+		if h.Stopped {
+			m.stopServer(h.Name)
+		}
+	}
+	return nil
+}
+
+// ExportConfig snapshots the running servers into a Config that can be fed
+// back to ImportConfig, with their inline keys redacted.
+func (m *MinihyperProxy) ExportConfig() *Config {
+	config := m.snapshotConfig()
+	for i, p := range config.Proxies {
+		config.Proxies[i].ServerOptions = p.ServerOptions.redacted()
+		for j, r := range p.Routes {
+			p.Routes[j].Upstream = r.Upstream.redacted()
+		}
+	}
+	for i, h := range config.Hoppers {
+		config.Hoppers[i].ServerOptions = h.ServerOptions.redacted()
+	}
+	return config
+}
+
+// snapshotConfig is ExportConfig keeping the keys, for the store and reloads.
+func (m *MinihyperProxy) snapshotConfig() *Config {
+	config := &Config{}
+
+	servers := m.serverList()
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch s := (*servers[name]).(type) {
+		case *ProxyServer:
+			config.Proxies = append(config.Proxies, s.exportConfig())
+		case *HopperServer:
+			config.Hoppers = append(config.Hoppers, s.exportConfig())
+		}
+	}
+	return config
+}
+
+func (s *ProxyServer) exportConfig() ProxyConfig {
+	status, _ := s.getStatus()
+	p := ProxyConfig{Name: s.ServerName, Hostname: s.Hostname, Port: s.ServerPort, Stopped: status == StatusDown,
+		ServerOptions: s.serverOptions()}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	keys := make([]string, 0, len(s.Routes))
+	for key := range s.Routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		r := s.Routes[key]
+		p.Routes = append(p.Routes, RouteConfig{Route: r.Route, Target: r.info(0).Target, RouteOptions: r.Options})
+	}
+	return p
+}
+
+func (h *HopperServer) exportConfig() HopperConfig {
+	c := HopperConfig{Name: h.ServerName, Hostname: h.Hostname, Stopped: h.combinedStatus() == StatusDown,
+		IncomingPort: h.IncomingHopProxy.ServerPort, OutgoingPort: h.OutgoingHopProxy.ServerPort,
+		ServerOptions: h.OutgoingHopProxy.serverOptions()}
+	outgoingHops, incomingHops, options := h.getOutgoingHops(), h.getIncomingHops(), h.getOutgoingHopOptions()
+	targets := h.getOutgoingTargets()
+	for _, host := range sortedURLKeys(outgoingHops) {
+		if h.isDiscovered(host) {
+			continue
+		}
+		target, ok := targets[host]
+		if !ok {
+			target = &url.URL{Scheme: "http", Host: host}
+		}
+		c.OutgoingHops = append(c.OutgoingHops, OutgoingHopConfig{Target: exportURL(target), Hop: exportURL(outgoingHops[host]), HopOptions: options[host]})
+	}
+	for _, host := range sortedURLKeys(incomingHops) {
+		// Incoming hops chained through the local outgoing proxy only remember
+		// the target hostname, which is all ReceiveHop needs to rebuild them.
+		target := incomingHops[host]
+		if target.Hostname() != host {
+			target = &url.URL{Scheme: "http", Host: host}
+		}
+		c.IncomingHops = append(c.IncomingHops, IncomingHopConfig{Target: exportURL(target)})
+	}
+	return c
+}
+
+func exportURL(u *url.URL) string {
+	if u.Scheme == "" {
+		withScheme := *u
+		withScheme.Scheme = "http"
+		return withScheme.String()
+	}
+	return u.String()
+}
+
+func sortedURLKeys(m map[string]*url.URL) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,131 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	data := `
+Proxies:
+  - Name: api
+    Routes:
+      - Route: /users
+        Target: http://localhost:9000/users
+      - Route: /
+        Target: http://localhost:9001
+        Match: Prefix
+        Host: "*.tenants.local"
+        Methods: [GET, HEAD]
+Hoppers:
+  - Name: edge
+    OutgoingHops:
+      - Target: http://www.example.com
+        Hop: http://localhost:7055
+    IncomingHops:
+      - Target: http://www.example.com
+`
+	config, err := ParseConfig("test.yaml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Proxies) != 1 || len(config.Proxies[0].Routes) != 2 || len(config.Hoppers) != 1 {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+	if r := config.Proxies[0].Routes[1]; r.Host != "*.tenants.local" || len(r.Methods) != 2 || r.Match != MatchPrefix {
+		t.Errorf("route options not parsed: %+v", r)
+	}
+
+	jsonData := `{"Proxies": [{"Name": "api", "Routes": [{"Route": "/users", "Target": "http://localhost:9000"}]}]}`
+	if _, err := ParseConfig("test.json", []byte(jsonData)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	cases := []struct {
+		data string
+		line int
+		msg  string
+	}{
+		{"Proxies:\n  - Name: api\n    Routes:\n      - Route: users\n        Target: http://localhost\n", 4, "must start with /"},
+		{"Proxies:\n  - Name: api\nHoppers:\n  - Name: api\n", 4, "already declared at line 2"},
+		{"Proxies:\n  - Name: api\n    Routes:\n      - Route: /\n        Target: http://a\n        Host: a.local\n      - Route: /\n        Target: http://b\n        Host: A.local\n", 7, "already declared at line 4"},
+		{"Proxies:\n  - Name: api\n    Routes:\n      - Route: ^/(\n        Target: http://a\n        Match: Regex\n", 4, "error parsing regexp"},
+		{"Hoppers:\n  - Name: edge\n    OutgoingHops:\n      - Target: http://example.com\n        Hop: localhost\n", 4, "invalid Hop"},
+		{"Proxies:\n  - Name: api\n    Listen: 80\n", 3, "not found"},
+		{"Proxies:\n  - Name: api\n    Port: http\n", 2, "invalid Port"},
+		{"Proxies: [\n", 1, "did not find expected node content"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseConfig("test.yaml", []byte(c.data))
+		configErr, ok := err.(*ConfigError)
+		if !ok {
+			t.Fatalf("expected ConfigError for %q, got %v", c.data, err)
+		}
+		if configErr.Line != c.line || !strings.Contains(configErr.Msg, c.msg) {
+			t.Errorf("expected line %d containing %q, got %v", c.line, c.msg, err)
+		}
+	}
+}
+
+func TestExportConfigRoundTrip(t *testing.T) {
+	m := NewMinihyperProxy()
+	m.startProxyServer("api", "", "", ServerOptions{})
+	m.addProxyRedirect("api", "/users", &url.URL{Scheme: "https", Host: "localhost:9000", Path: "/v1/users"}, RouteOptions{})
+	m.startHopperServer("edge", "", "", "", ServerOptions{})
+	m.AddHop("edge", &url.URL{Scheme: "http", Host: "www.example.com"}, &url.URL{Scheme: "http", Host: "localhost:7100"}, HopOptions{})
+	m.ReceiveHop("edge", &url.URL{Scheme: "http", Host: "www.example.com"}, &url.URL{Scheme: "http", Host: "localhost:7100"})
+	m.ReceiveHop("edge", &url.URL{Scheme: "https", Host: "www.example.org"}, &url.URL{Scheme: "http", Host: "localhost:7100"})
+
+	exported, err := json.Marshal(m.ExportConfig())
+	m.stopServer("api")
+	m.stopServer("edge")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ParseConfig("export.json", exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Proxies) != 1 || config.Proxies[0].Routes[0].Target != "https://localhost:9000/v1/users" {
+		t.Fatalf("unexpected proxies in %s", exported)
+	}
+	if len(config.Hoppers) != 1 || len(config.Hoppers[0].OutgoingHops) != 1 || len(config.Hoppers[0].IncomingHops) != 2 {
+		t.Fatalf("unexpected hoppers in %s", exported)
+	}
+
+	imported := NewMinihyperProxy()
+	if err := imported.importConfig("export.json", config); err != nil {
+		t.Fatal(err)
+	}
+	reexported, _ := json.Marshal(imported.ExportConfig())
+	imported.stopServer("api")
+	imported.stopServer("edge")
+	if string(reexported) != string(exported) {
+		t.Errorf("config did not round trip:\n%s\n%s", exported, reexported)
+	}
+}
+
+func TestImportConfigRollback(t *testing.T) {
+	m := NewMinihyperProxy()
+	config := &Config{
+		Proxies: []ProxyConfig{{Name: "api", Routes: []RouteConfig{{Route: "/users", Target: "http://localhost:9000"}}}},
+		Hoppers: []HopperConfig{{Name: "edge"}, {Name: "api"}},
+	}
+	if err := m.importConfig("test", config); err == nil {
+		t.Fatal("expected the duplicate server name to fail the import")
+	}
+	if len(m.Servers) != 0 {
+		t.Errorf("expected the failed import to remove the servers it started, got %v", m.serverList())
+	}
+	if err := m.importConfig("test", &Config{Proxies: config.Proxies, Hoppers: config.Hoppers[:1]}); err != nil {
+		t.Fatalf("expected the freed names and ports to be reusable: %v", err)
+	}
+	m.removeServer("api")
+	m.removeServer("edge")
+}
@@ -5,4 +5,5 @@ go 1.14
 require (
 	github.com/gorilla/mux v1.8.0
 	github.com/mitchellh/mapstructure v1.3.3
+	gopkg.in/yaml.v3 v3.0.1
 )
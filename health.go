@@ -0,0 +1,235 @@
+package minihyperproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck probes every target of a route with a GET on Path. A target
+// leaves rotation after UnhealthyThreshold failed probes in a row and comes
+// back after HealthyThreshold successful ones. Durations use Go syntax, as in
+// "500ms" or "10s".
+type HealthCheck struct {
+	Path               string `json:"Path" yaml:"Path"`
+	Interval           string `json:"Interval,omitempty" yaml:"Interval,omitempty"`
+	Timeout            string `json:"Timeout,omitempty" yaml:"Timeout,omitempty"`
+	HealthyThreshold   int    `json:"HealthyThreshold,omitempty" yaml:"HealthyThreshold,omitempty"`
+	UnhealthyThreshold int    `json:"UnhealthyThreshold,omitempty" yaml:"UnhealthyThreshold,omitempty"`
+}
+
+// OutlierDetection ejects a target from rotation for EjectionTime after
+// ConsecutiveFailures requests to it in a row failed with a 5xx or a
+// connection error.
+type OutlierDetection struct {
+	ConsecutiveFailures int    `json:"ConsecutiveFailures,omitempty" yaml:"ConsecutiveFailures,omitempty"`
+	EjectionTime        string `json:"EjectionTime,omitempty" yaml:"EjectionTime,omitempty"`
+}
+
+type healthSettings struct {
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+type outlierSettings struct {
+	consecutiveFailures int64
+	ejectionTime        time.Duration
+}
+
+func parseDuration(name string, value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return duration, nil
+}
+
+func orDefault(value int, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+func (c *HealthCheck) settings() (s *healthSettings, err error) {
+	if !strings.HasPrefix(c.Path, "/") {
+		return nil, fmt.Errorf("health check Path %q must start with /", c.Path)
+	}
+	s = &healthSettings{path: c.Path,
+		healthyThreshold:   orDefault(c.HealthyThreshold, 2),
+		unhealthyThreshold: orDefault(c.UnhealthyThreshold, 3)}
+	if s.interval, err = parseDuration("Interval", c.Interval, 10*time.Second); err != nil {
+		return nil, err
+	}
+	if s.timeout, err = parseDuration("Timeout", c.Timeout, 2*time.Second); err != nil {
+		return nil, err
+	}
+	if s.healthyThreshold < 1 || s.unhealthyThreshold < 1 {
+		return nil, fmt.Errorf("health check thresholds must be positive")
+	}
+	return
+}
+
+func (o *OutlierDetection) settings() (s *outlierSettings, err error) {
+	s = &outlierSettings{consecutiveFailures: int64(orDefault(o.ConsecutiveFailures, 5))}
+	if s.ejectionTime, err = parseDuration("EjectionTime", o.EjectionTime, 30*time.Second); err != nil {
+		return nil, err
+	}
+	if s.consecutiveFailures < 1 {
+		return nil, fmt.Errorf("ConsecutiveFailures must be positive")
+	}
+	return
+}
+
+func (p *UpstreamPool) configureHealth(options RouteOptions) (err error) {
+	if options.HealthCheck != nil {
+		if p.healthCheck, err = options.HealthCheck.settings(); err != nil {
+			return
+		}
+	}
+	if options.Outlier != nil {
+		p.outlier, err = options.Outlier.settings()
+	}
+	return
+}
+
+// available tells whether u passes its health checks and is not ejected.
+func (u *Upstream) available(now time.Time) bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0 && atomic.LoadInt64(&u.ejectedUntil) < now.UnixNano()
+}
+
+// observe feeds the outcome of a proxied request to outlier detection.
+func (p *UpstreamPool) observe(u *Upstream, failed bool) {
+	if p.outlier == nil {
+		return
+	}
+	if !failed {
+		atomic.StoreInt64(&u.consecutiveFailures, 0)
+		return
+	}
+	if atomic.AddInt64(&u.consecutiveFailures, 1) >= p.outlier.consecutiveFailures {
+		atomic.StoreInt64(&u.consecutiveFailures, 0)
+		atomic.StoreInt64(&u.ejectedUntil, time.Now().Add(p.outlier.ejectionTime).UnixNano())
+		atomic.AddUint64(&u.ejections, 1)
+	}
+}
+
+// startChecks starts probing the targets, unless the pool has no health
+// check or is probing already.
+func (p *UpstreamPool) startChecks() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.healthCheck == nil || p.stopChecks != nil {
+		return
+	}
+	done := make(chan struct{})
+	p.stopChecks = func() { close(done) }
+	client := &http.Client{Timeout: p.healthCheck.timeout, Transport: p.transport}
+	for _, u := range p.upstreams {
+		go p.checkLoop(u, client, done)
+	}
+}
+
+func (p *UpstreamPool) stopHealthChecks() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopChecks != nil {
+		p.stopChecks()
+		p.stopChecks = nil
+	}
+}
+
+func (p *UpstreamPool) checkLoop(u *Upstream, client *http.Client, done chan struct{}) {
+	ticker := time.NewTicker(p.healthCheck.interval)
+	defer ticker.Stop()
+	probeURL := *u.URL
+	probeURL.Path = p.healthCheck.path
+	probeURL.RawQuery = ""
+	var successes, failures int
+	for {
+		err := probe(client, probeURL.String())
+		u.setCheckError(err)
+		if err == nil {
+			successes, failures = successes+1, 0
+			if successes >= p.healthCheck.healthyThreshold {
+				atomic.StoreInt32(&u.unhealthy, 0)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if failures >= p.healthCheck.unhealthyThreshold {
+				atomic.StoreInt32(&u.unhealthy, 1)
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probe(client *http.Client, probeURL string) error {
+	resp, err := client.Get(probeURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (u *Upstream) setCheckError(err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	u.lastCheckError.Store(message)
+}
+
+func (u *Upstream) checkError() string {
+	message, _ := u.lastCheckError.Load().(string)
+	return message
+}
+
+// getHealth lists the targets of every route with a pool, by route key.
+func (s *ProxyServer) getHealth() map[string][]UpstreamStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	health := make(map[string][]UpstreamStats)
+	for key, r := range s.Routes {
+		if r.pool != nil {
+			health[key] = r.pool.stats()
+		}
+	}
+	return health
+}
+
+func (s *ProxyServer) startHealthChecks() {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, r := range s.Routes {
+		if r.pool != nil {
+			r.pool.startChecks()
+		}
+	}
+}
+
+func (s *ProxyServer) stopHealthChecks() {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, r := range s.Routes {
+		if r.pool != nil {
+			r.pool.stopHealthChecks()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func getBody(t *testing.T, url string) (int, string) {
+	r, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	body, _ := ioutil.ReadAll(r.Body)
+	return r.StatusCode, string(body)
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	var sick int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&sick) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+	steady := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("steady"))
+	}))
+	defer steady.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	body := `{"Name": "api", "Route": "/svc", "Targets": [{"URL": "` + flaky.URL + `"}, {"URL": "` + steady.URL + `"}],
+		"HealthCheck": {"Path": "/healthz", "Interval": "20ms", "Timeout": "1s", "HealthyThreshold": 1, "UnhealthyThreshold": 1}}`
+	if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+		t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+	}
+	if resp := callAPI(t, api, "POST", "/proxy/route", `{"Name": "api", "Route": "/bad", "Targets": [{"URL": "`+steady.URL+`"}], "HealthCheck": {"Path": "healthz"}}`); resp.Code != 422 {
+		t.Errorf("health check path without slash: expected 422, got %d", resp.Code)
+	}
+
+	flakyHealthy := func(expected bool) func() bool {
+		return func() bool {
+			health := HealthResponse{}
+			json.Unmarshal(callAPI(t, api, "GET", "/proxy/health", `{"Name": "api"}`).Body.Bytes(), &health)
+			stats := health.Health["/svc"]
+			return len(stats) == 2 && stats[0].Healthy == expected && (expected || stats[0].LastCheckError != "")
+		}
+	}
+
+	atomic.StoreInt32(&sick, 1)
+	waitFor(t, "the flaky target to be marked unhealthy", flakyHealthy(false))
+	for i := 0; i < 4; i++ {
+		if _, got := getBody(t, "http://localhost:"+created.Port+"/svc"); got != "steady" {
+			t.Errorf("unhealthy target still in rotation: got %s", got)
+		}
+	}
+
+	atomic.StoreInt32(&sick, 0)
+	waitFor(t, "the flaky target to recover", flakyHealthy(true))
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		_, got := getBody(t, "http://localhost:"+created.Port+"/svc")
+		seen[got] = true
+	}
+	if !seen["flaky"] || !seen["steady"] {
+		t.Errorf("recovered target not back in rotation: %v", seen)
+	}
+
+	servers := ListServersResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy", `{"Name": "api"}`).Body.Bytes(), &servers)
+	if len(servers.Info) != 1 || (*servers.Info[0])["Health"] == nil {
+		t.Errorf("health not reported in server info: %+v", servers.Info)
+	}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	for _, body := range []string{
+		`{"Name": "api", "Route": "/svc", "Targets": [{"URL": "` + failing.URL + `"}, {"URL": "` + ok.URL + `"}], "Outlier": {"ConsecutiveFailures": 2, "EjectionTime": "1m"}}`,
+		`{"Name": "api", "Route": "/down", "Targets": [{"URL": "` + failing.URL + `"}], "Outlier": {"ConsecutiveFailures": 1, "EjectionTime": "1m"}}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+			t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+		}
+	}
+
+	statuses := make(map[int]int)
+	for i := 0; i < 10; i++ {
+		status, _ := getBody(t, "http://localhost:"+created.Port+"/svc")
+		statuses[status]++
+	}
+	if statuses[http.StatusInternalServerError] != 2 || statuses[http.StatusOK] != 8 {
+		t.Errorf("failing target not ejected after 2 failures: %v", statuses)
+	}
+
+	health := HealthResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy/health", `{"Name": "api"}`).Body.Bytes(), &health)
+	if stats := health.Health["/svc"]; len(stats) != 2 || !stats[0].Ejected || stats[0].Ejections != 1 || stats[1].Ejected {
+		t.Errorf("unexpected health %+v", stats)
+	}
+
+	getBody(t, "http://localhost:"+created.Port+"/down")
+	if status, _ := getBody(t, "http://localhost:"+created.Port+"/down"); status != http.StatusServiceUnavailable {
+		t.Errorf("route without healthy targets: expected 503, got %d", status)
+	}
+	if resp := callAPI(t, api, "GET", "/proxy/health", `{"Name": "missing"}`); resp.Code != NoServerFoundError.code {
+		t.Errorf("health of a missing server: expected %d, got %d", NoServerFoundError.code, resp.Code)
+	}
+}
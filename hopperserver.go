@@ -3,6 +3,7 @@ package minihyperproxy
 //Usare http/url
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -10,8 +11,46 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// HopOptions are the settings of an outgoing hop beyond its target and hop.
+// Via lists, in order, the incoming hop proxies of further hoppers the
+// requests go through after the hop, each of which must have received the
+// target. Register has the hoppers on the way register the incoming hop
+// themselves, which they only accept with HopSigning or PeerTLS.
+type HopOptions struct {
+	Breaker  *CircuitBreaker `json:"Breaker,omitempty" yaml:"Breaker,omitempty"`
+	Via      []string        `json:"Via,omitempty" yaml:"Via,omitempty"`
+	Register bool            `json:"Register,omitempty" yaml:"Register,omitempty"`
+}
+
+type hopTransportKey struct{}
+
+func appendHop(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "," + name
+}
+
+// parseHopRoute parses the hops left in an X-MHP-Hop-Route header.
+func parseHopRoute(route string) (hops []*url.URL, err error) {
+	if route == "" {
+		return nil, nil
+	}
+	for _, rawHop := range strings.Split(route, ",") {
+		hop, err := url.Parse(strings.TrimSpace(rawHop))
+		if err != nil || (hop.Scheme != "http" && hop.Scheme != "https") || hop.Host == "" {
+			return nil, fmt.Errorf("invalid hop %q", rawHop)
+		}
+		_, hop = reduceTargetHop(hop, hop)
+		hops = append(hops, hop)
+	}
+	return
+}
+
 type HopperServer struct {
 	ServerName            string
 	Hostname              string
@@ -22,9 +61,20 @@ type HopperServer struct {
 	incomingHopPort       int
 	IncomingHopsReference map[string]*url.URL
 	OutgoingHopsReference map[string]*url.URL
+	outgoingHopOptions    map[string]HopOptions
+	outgoingTargets       map[string]*url.URL
+	registrations         map[string]*registration
+	stopReconciling       func()
+	mesh                  *mesh
+	discovered            map[string]bool
+	hopBreakers           map[string]*breaker
+	identity              string
+	signer                *hopSigner
 	IncomingHopProxy      *ProxyServer
 	OutgoingHopProxy      *ProxyServer
-	Status                string
+	lock                  sync.RWMutex
+	lifecycleLock         sync.Mutex
+	registrationLock      sync.Mutex
 }
 
 func NewHopperServer(serverName string, hostname string, incomingHopPort string, outgoingHopPort string) *HopperServer {
@@ -41,7 +91,12 @@ func NewHopperServer(serverName string, hostname string, incomingHopPort string,
 		incomingHopPort:       incomingHopPortInt,
 		OutgoingHopsReference: make(map[string]*url.URL),
 		IncomingHopsReference: make(map[string]*url.URL),
-		Status:                "Down"}
+		outgoingHopOptions:    make(map[string]HopOptions),
+		outgoingTargets:       make(map[string]*url.URL),
+		registrations:         make(map[string]*registration),
+		discovered:            make(map[string]bool),
+		hopBreakers:           make(map[string]*breaker),
+		identity:              newHopperIdentity()}
 
 	s.init(hostname, incomingHopPort, outgoingHopPort)
 	return s
@@ -51,6 +106,29 @@ func (h *HopperServer) Name() string {
 	return h.ServerName
 }
 
+func (h *HopperServer) outgoingHop(targetHost string) (hop *url.URL, ok bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	hop, ok = h.OutgoingHopsReference[targetHost]
+	return
+}
+
+func (h *HopperServer) incomingHop(targetHost string) (target *url.URL, ok bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	target, ok = h.IncomingHopsReference[targetHost]
+	return
+}
+
+func copyURLs(urls map[string]*url.URL) map[string]*url.URL {
+	copied := make(map[string]*url.URL, len(urls))
+	for key, value := range urls {
+		u := *value
+		copied[key] = &u
+	}
+	return copied
+}
+
 func (h *HopperServer) outgoingHopperDirector(req *http.Request) {
 	tempString := strings.SplitAfterN(req.URL.EscapedPath(), "/", 3)
 	targetHost := strings.Trim(tempString[1], "/")
@@ -58,28 +136,31 @@ func (h *HopperServer) outgoingHopperDirector(req *http.Request) {
 	if len(tempString) == 3 {
 		targetPath = tempString[2]
 	}
-	if newURL, ok := h.OutgoingHopsReference[targetHost]; ok {
-		if _, ok := req.Header["X-MHP-Target-Host"]; !ok {
-			req.Header.Set("X-MHP-Target-Host", targetHost)
-			if _, ok := req.Header["X-MHP-Target-Scheme"]; !ok {
-				req.Header.Set("X-MHP-Target-Scheme", req.URL.Scheme)
-			}
-			if _, ok := req.Header["X-MHP-Target-Path"]; !ok {
-				req.Header.Set("X-MHP-Target-Path", targetPath)
-			}
-			if _, ok := req.Header["X-MHP-Target-Query"]; !ok {
-				req.Header.Set("X-MHP-Target-Query", req.URL.RawQuery)
-			}
-			if _, ok := req.Header["X-MHP-Forwarded-Host"]; !ok {
-				req.Header.Set("X-MHP-Forwarded-Host", req.Header.Get("Host"))
-			}
+	if newURL, ok := h.outgoingHop(targetHost); ok {
+		// Requests start their hop chain here, whatever headers they carry.
+		req.Header.Set("X-MHP-Target-Host", targetHost)
+		req.Header.Set("X-MHP-Target-Scheme", req.URL.Scheme)
+		req.Header.Set("X-MHP-Target-Path", targetPath)
+		req.Header.Set("X-MHP-Target-Query", req.URL.RawQuery)
+		if _, ok := req.Header["X-MHP-Forwarded-Host"]; !ok {
+			req.Header.Set("X-MHP-Forwarded-Host", req.Header.Get("Host"))
+		}
+		if via := h.hopVia(targetHost); len(via) > 0 {
+			req.Header.Set("X-MHP-Hop-Route", strings.Join(via, ","))
+		} else {
+			req.Header.Del("X-MHP-Hop-Route")
+		}
+		if signer := h.getSigner(); signer != nil {
+			signer.sign(req)
 		}
 		if _, ok := req.Header["User-Agent"]; !ok {
 			// explicitly disable User-Agent so it's not set to default value
 			req.Header.Set("User-Agent", "")
 		}
 		req.Header.Set("X-Forwarded-Host", req.Header.Get("X-MHP-Forwarded-Host"))
-		req.URL = newURL
+		// newURL is shared by every request through this hop.
+		hopURL := *newURL
+		req.URL = &hopURL
 		req.Host = newURL.Host
 	} else {
 		_, cancel := context.WithCancel(req.Context())
@@ -93,15 +174,30 @@ func (h *HopperServer) incomingHopperDirector(req *http.Request) {
 		cancel()
 	}
 	targetHost := req.Header.Get("X-MHP-Target-Host")
+	if next, route, err := h.nextHop(req); err == nil && next != nil {
+		if len(route) > 0 {
+			req.Header.Set("X-MHP-Hop-Route", strings.Join(route, ","))
+		} else {
+			req.Header.Del("X-MHP-Hop-Route")
+		}
+		if signer := h.getSigner(); signer != nil {
+			signer.sign(req)
+		}
+		hopURL := *next
+		req.URL = &hopURL
+		req.Host = next.Host
+		return
+	}
 	targetPath := req.Header.Get("X-MHP-Target-Path")
 	targetQuery := req.Header.Get("X-MHP-Target-Query")
 	targetScheme := req.Header.Get("X-MHP-Target-Scheme")
-	if newURL, ok := h.IncomingHopsReference[targetHost]; ok {
+	if newURL, ok := h.incomingHop(targetHost); ok {
 		if newURL.Host == targetHost {
 			req.Header.Set("X-Forwarded-Host", req.Header.Get("X-MHP-Forwarded-Host"))
 		}
-		req.URL = newURL
-		req.URL.Path = targetPath
+		targetURL := *newURL
+		req.URL = &targetURL
+		req.URL.Path = singleJoiningSlash("/", targetPath)
 		req.URL.RawQuery = targetQuery
 		if targetScheme == "" {
 			targetScheme = "http"
@@ -113,24 +209,88 @@ func (h *HopperServer) incomingHopperDirector(req *http.Request) {
 		req.Header.Del("X-MHP-Target-Path")
 		req.Header.Del("X-MHP-Target-Query")
 		req.Header.Del("X-MHP-Target-Scheme")
+		req.Header.Del("X-MHP-Hop-Route")
+		req.Header.Del("X-MHP-Hop-Timestamp")
+		req.Header.Del("X-MHP-Hop-Nonce")
+		req.Header.Del("X-MHP-Hop-Signature")
 	}
 }
 
+// nextHop is where an incoming hop goes after this hopper, if anywhere: the
+// first hop left in its route, or the outgoing hop of this hopper to its
+// target. route is what is left of the route afterwards.
+func (h *HopperServer) nextHop(req *http.Request) (next *url.URL, route []string, err error) {
+	hops, err := parseHopRoute(req.Header.Get("X-MHP-Hop-Route"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hops) > 0 {
+		for _, hop := range hops[1:] {
+			route = append(route, hop.String())
+		}
+		return hops[0], route, nil
+	}
+	next, _ = h.outgoingHop(req.Header.Get("X-MHP-Target-Host"))
+	return
+}
+
+func (h *HopperServer) hopVia(targetHost string) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.outgoingHopOptions[targetHost].Via
+}
+
+func (h *HopperServer) hopBreaker(targetHost string) *breaker {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.hopBreakers[targetHost]
+}
+
 func (h *HopperServer) serveOutgoingRequest(rProxy *httputil.ReverseProxy, resp http.ResponseWriter, req *http.Request) {
 	targetHost := strings.Trim(strings.SplitAfter(req.URL.EscapedPath(), "/")[1], "/")
-	if _, ok := h.OutgoingHopsReference[targetHost]; !ok {
+	if _, ok := h.outgoingHop(targetHost); !ok {
 		resp.WriteHeader(http.StatusInternalServerError)
 		resp.Write([]byte("500 - Hop not registered for " + targetHost))
+	} else if !h.stampOrReject(resp, req) {
+		return
+	} else if b := h.hopBreaker(targetHost); b != nil {
+		if !b.allow(resp) {
+			h.warnLog.Printf("Circuit breaker open for hop to %v", targetHost)
+			return
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: resp}
+		rProxy.ServeHTTP(recorder, req)
+		b.record(recorder.status >= http.StatusInternalServerError, time.Since(start))
 	} else {
 		rProxy.ServeHTTP(resp, req)
 	}
 }
 
 func (h *HopperServer) serveIncomingRequest(rProxy *httputil.ReverseProxy, resp http.ResponseWriter, req *http.Request) {
-	if _, ok := h.IncomingHopsReference[req.Header.Get("X-MHP-Target-Host")]; !ok {
+	if !h.verifyOrReject(resp, req) {
+		return
+	} else if req.URL.Path == controlPath {
+		h.serveControl(resp, req)
+	} else if req.URL.Path == gossipPath {
+		h.serveGossip(resp, req)
+	} else if _, ok := h.incomingHop(req.Header.Get("X-MHP-Target-Host")); !ok {
 		resp.WriteHeader(http.StatusInternalServerError)
 		resp.Write([]byte("500 - Hop not registered for " + req.Header.Get("X-MHP-Target-Host")))
+	} else if !h.stampOrReject(resp, req) {
+		return
+	} else if next, _, err := h.nextHop(req); err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte("400 - " + err.Error()))
 	} else {
+		if next != nil {
+			// Hops to further hoppers use the transport of the outgoing
+			// hop proxy, which presents the PeerTLS certificate.
+			transport, _ := h.OutgoingHopProxy.upstreamTransport()
+			req = req.WithContext(context.WithValue(req.Context(), hopTransportKey{}, transport))
+		} else {
+			resp.Header().Set("X-MHP-Hop-Path", req.Header.Get("X-MHP-Hop-Path"))
+		}
 		rProxy.ServeHTTP(resp, req)
 	}
 }
@@ -150,38 +310,132 @@ func (h *HopperServer) init(hostname string, incomingHopPort string, outgoingHop
 	h.OutgoingHopProxy.StartOutgoingHopProxy(h.outgoingHopperDirector, h.serveOutgoingRequest)
 }
 
-func (h *HopperServer) Serve() {
-	h.Status = "Up"
-	h.OutgoingHopProxy.Serve()
-	h.IncomingHopProxy.Serve()
+// configure applies options, validated by the caller, to both hop proxies.
+// With PeerTLS, the incoming hop proxy only accepts peers presenting a
+// trusted certificate, and the outgoing one presents its own. With
+// HopSigning, hops are signed when leaving and verified when arriving.
+func (h *HopperServer) configure(options ServerOptions) {
+	h.IncomingHopProxy.configure(options)
+	h.OutgoingHopProxy.configure(options)
+	h.lock.Lock()
+	h.signer = nil
+	if options.HopSigning != nil {
+		h.signer, _ = options.HopSigning.settings()
+	}
+	h.mesh = nil
+	if options.Mesh != nil {
+		settings, _ := options.Mesh.settings()
+		h.mesh = newMesh(settings)
+	}
+	h.lock.Unlock()
+	if options.PeerTLS != nil {
+		server, client, _ := options.PeerTLS.configs()
+		h.IncomingHopProxy.tlsConfig.Store(server)
+		h.OutgoingHopProxy.setClientTLS(client)
+	}
+}
+
+func (h *HopperServer) Serve() error {
+	h.lifecycleLock.Lock()
+	defer h.lifecycleLock.Unlock()
+	if err := h.OutgoingHopProxy.Serve(); err != nil {
+		return err
+	}
+	if err := h.IncomingHopProxy.Serve(); err != nil {
+		h.OutgoingHopProxy.Stop()
+		return err
+	}
+	h.startReconciling()
+	h.startGossiping()
+	return nil
 }
 
 func (h *HopperServer) Stop() {
-	h.Status = "Down"
+	h.lifecycleLock.Lock()
+	defer h.lifecycleLock.Unlock()
+	h.stopReconcile()
+	h.stopGossiping()
 	h.OutgoingHopProxy.Stop()
 	h.IncomingHopProxy.Stop()
 }
 
-func (h *HopperServer) putOutgoingHop(target *url.URL, hop *url.URL) *url.URL {
+// combinedStatus is Up or Down only when both hop proxies agree, Failed if
+// either of them failed and the status of the lagging one otherwise.
+func (h *HopperServer) combinedStatus() string {
+	outgoing, _ := h.OutgoingHopProxy.getStatus()
+	incoming, _ := h.IncomingHopProxy.getStatus()
+	switch {
+	case outgoing == StatusFailed || incoming == StatusFailed:
+		return StatusFailed
+	case outgoing == incoming:
+		return outgoing
+	case outgoing == StatusUp:
+		return incoming
+	}
+	return outgoing
+}
+
+func (h *HopperServer) lastError() error {
+	if _, err := h.IncomingHopProxy.getStatus(); err != nil {
+		return err
+	}
+	_, err := h.OutgoingHopProxy.getStatus()
+	return err
+}
+
+func (h *HopperServer) putOutgoingHop(target *url.URL, hop *url.URL, options HopOptions, b *breaker) *url.URL {
+	h.lock.Lock()
+	defer h.lock.Unlock()
 	h.infoLog.Printf("Creating outgoing hop for %v, hop %v", target, hop)
 	hostname := target.Hostname()
 	h.OutgoingHopsReference[hostname] = hop
+	h.outgoingHopOptions[hostname] = options
+	h.outgoingTargets[hostname] = target
+	delete(h.discovered, hostname)
+	if b != nil {
+		h.hopBreakers[hostname] = b
+	} else {
+		delete(h.hopBreakers, hostname)
+	}
 	if val, ok := h.IncomingHopsReference[hostname]; ok && val.Host == hostname {
 		h.IncomingHopsReference[hostname] = hop
 	}
 	return target
 }
 
-func (h *HopperServer) deleteOutgoingHop(target *url.URL) *url.URL {
-	h.infoLog.Printf("Deleting hop to %v", target)
-	delete(h.OutgoingHopsReference, target.Hostname())
-	return target
+func (h *HopperServer) deleteOutgoingHop(target *url.URL) bool {
+	h.registrationLock.Lock()
+	defer h.registrationLock.Unlock()
+	hop, registered, options, ok := h.takeOutgoingHop(target)
+	if ok && options.Register {
+		h.unregisterRoute(registered, hop, options.Via)
+	}
+	return ok
+}
+
+func (h *HopperServer) takeOutgoingHop(target *url.URL) (hop *url.URL, registered *url.URL, options HopOptions, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hostname := target.Hostname()
+	if hop, ok = h.OutgoingHopsReference[hostname]; !ok {
+		return
+	}
+	h.infoLog.Printf("Deleting outgoing hop to %v", target)
+	registered, options = h.outgoingTargets[hostname], h.outgoingHopOptions[hostname]
+	delete(h.OutgoingHopsReference, hostname)
+	delete(h.outgoingHopOptions, hostname)
+	delete(h.outgoingTargets, hostname)
+	delete(h.hopBreakers, hostname)
+	delete(h.discovered, hostname)
+	return
 }
 
 func (h *HopperServer) putIncomingHop(target *url.URL) *url.URL {
+	h.lock.Lock()
+	defer h.lock.Unlock()
 	hostname := target.Hostname()
 	h.infoLog.Printf("Creating incoming hop for %v", target)
-	if _, ok := h.OutgoingHopsReference[hostname]; ok {
+	if _, ok := h.OutgoingHopsReference[hostname]; ok && !h.discovered[hostname] {
 		h.IncomingHopsReference[hostname] = &url.URL{Host: "localhost:" + h.OutgoingHopProxy.ServerPort}
 	} else {
 		h.IncomingHopsReference[hostname] = target
@@ -189,26 +443,105 @@ func (h *HopperServer) putIncomingHop(target *url.URL) *url.URL {
 	return target
 }
 
-func (h *HopperServer) deleteIncomingHop(target *url.URL) *url.URL {
-	h.IncomingHopProxy.DeleteProxy(target)
-	return target
+func (h *HopperServer) deleteIncomingHop(target *url.URL) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hostname := target.Hostname()
+	if _, ok := h.IncomingHopsReference[hostname]; !ok {
+		return false
+	}
+	h.infoLog.Printf("Deleting incoming hop for %v", target)
+	delete(h.IncomingHopsReference, hostname)
+	delete(h.registrations, hostname)
+	return true
 }
-func (h *HopperServer) BuildNewOutgoingHop(target *url.URL, hop *url.URL) {
+
+// BuildNewOutgoingHop adds the hop, once registered on the remote hoppers
+// if options ask for it.
+func (h *HopperServer) BuildNewOutgoingHop(target *url.URL, hop *url.URL, options HopOptions) (err error) {
+	return h.buildOutgoingHop(target, hop, options, true)
+}
+
+// restoreOutgoingHop adds the hop, leaving its registration to the
+// background, since remote hoppers may not be up yet.
+func (h *HopperServer) restoreOutgoingHop(target *url.URL, hop *url.URL, options HopOptions) (err error) {
+	return h.buildOutgoingHop(target, hop, options, false)
+}
+
+func (h *HopperServer) buildOutgoingHop(target *url.URL, hop *url.URL, options HopOptions, register bool) (err error) {
+	if _, err = parseHopRoute(strings.Join(options.Via, ",")); err != nil {
+		return
+	}
+	var b *breaker
+	if options.Breaker != nil {
+		if b, err = options.Breaker.newBreaker(); err != nil {
+			return
+		}
+	}
 	target, hop = reduceTargetHop(target, hop)
-	h.putOutgoingHop(target, hop)
+	if options.Register && !register {
+		h.putOutgoingHop(target, hop, options, b)
+		go h.reconcile()
+		return
+	}
+	h.registrationLock.Lock()
+	defer h.registrationLock.Unlock()
+	if options.Register {
+		if err = h.registerRoute(target, hop, options.Via); err != nil {
+			return
+		}
+	}
+	h.putOutgoingHop(target, hop, options, b)
+	return
 }
 
 func (h *HopperServer) BuildNewIncomingHop(target *url.URL, hop *url.URL) {
 	target, _ = reduceTargetHop(target, hop)
+	h.lock.Lock()
+	// An incoming hop added by hand outlives the registrations.
+	if reg, ok := h.registrations[target.Hostname()]; ok {
+		reg.owned = false
+	}
+	h.lock.Unlock()
 	h.putIncomingHop(target)
 }
 
 func (h *HopperServer) getIncomingHops() map[string]*url.URL {
-	return h.IncomingHopsReference
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return copyURLs(h.IncomingHopsReference)
 }
 
 func (h *HopperServer) getOutgoingHops() map[string]*url.URL {
-	return h.OutgoingHopsReference
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return copyURLs(h.OutgoingHopsReference)
+}
+
+func (h *HopperServer) getOutgoingTargets() map[string]*url.URL {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return copyURLs(h.outgoingTargets)
+}
+
+func (h *HopperServer) getOutgoingHopOptions() map[string]HopOptions {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	options := make(map[string]HopOptions, len(h.outgoingHopOptions))
+	for host, o := range h.outgoingHopOptions {
+		options[host] = o
+	}
+	return options
+}
+
+func (h *HopperServer) getHopBreakers() map[string]*BreakerStats {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	stats := make(map[string]*BreakerStats, len(h.hopBreakers))
+	for host, b := range h.hopBreakers {
+		stats[host] = b.stats()
+	}
+	return stats
 }
 
 func (h *HopperServer) Type() string {
@@ -221,6 +554,16 @@ func (s *HopperServer) Info() *map[string]interface{} {
 	ret["IncomingPort"] = s.incomingHopPort
 	ret["OutgoingPort"] = s.outgoingHopPort
 	ret["Type"] = s.Type()
-	ret["Status"] = s.Status
+	ret["Identity"] = s.identity
+	ret["Status"] = s.combinedStatus()
+	if lastError := s.lastError(); lastError != nil {
+		ret["LastError"] = lastError.Error()
+	}
+	if options := s.OutgoingHopProxy.serverOptions(); options != (ServerOptions{}) {
+		ret["Options"] = options.redacted()
+	}
+	if m := s.getMesh(); m != nil {
+		ret["Peers"] = m.alive()
+	}
 	return &ret
 }
@@ -9,6 +9,26 @@ func (h *HttpError) Error() string {
 	return h.ErrString
 }
 
+func newServerBindError(err error) *HttpError {
+	return &HttpError{ErrString: "Could not bind server: " + err.Error(), code: 500}
+}
+
+func newInvalidRouteError(err error) *HttpError {
+	return &HttpError{ErrString: "Invalid route: " + err.Error(), code: 422}
+}
+
+func newInvalidOptionsError(err error) *HttpError {
+	return &HttpError{ErrString: "Invalid options: " + err.Error(), code: 422}
+}
+
+func newInvalidHopError(err error) *HttpError {
+	return &HttpError{ErrString: "Invalid hop: " + err.Error(), code: 422}
+}
+
+func newHopRegistrationError(err error) *HttpError {
+	return &HttpError{ErrString: "Hop registration failed: " + err.Error(), code: 502}
+}
+
 var BodyUnmarshallError = &HttpError{ErrString: "Error unmarshalling body", code: 422}
 var InvalidBodyError = &HttpError{ErrString: "Invalid body structure", code: 422}
 var RequestUnmarshallError = &HttpError{ErrString: "Error unmarshalling request", code: 422}
@@ -18,3 +38,10 @@ var ServerHostnamePortTakenError = &HttpError{ErrString: "Server with provided h
 var NoServerFoundError = &HttpError{ErrString: "Server not Found", code: 500}
 var WrongServerTypeError = &HttpError{ErrString: "Wrong server Type", code: 500}
 var URLParsingError = &HttpError{ErrString: "Can't parse given URL", code: 500}
+var NoRouteFoundError = &HttpError{ErrString: "Route not Found", code: 404}
+var NoHopFoundError = &HttpError{ErrString: "Hop not Found", code: 404}
+var NoReloadError = &HttpError{ErrString: "No config reload happened yet", code: 404}
+var ServerAlreadyStoppedError = &HttpError{ErrString: "Server is already stopped", code: 409}
+var ServerAlreadyRunningError = &HttpError{ErrString: "Server is already running", code: 409}
+var NoFreePortError = &HttpError{ErrString: "No free port left in range", code: 503}
+var InvalidPortError = &HttpError{ErrString: "Invalid port", code: 422}
@@ -0,0 +1,63 @@
+package minihyperproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxHops bounds the hoppers a request goes through when MaxHops is
+// not set.
+const defaultMaxHops = 16
+
+func newHopperIdentity() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// stamp records the passage of req through h, in the X-MHP-Hop-Ids and
+// X-MHP-Hop-Path headers, and decrements its X-MHP-Hop-TTL, capped by the
+// MaxHops of h. It fails if req went through h already or has no hops left.
+func (h *HopperServer) stamp(req *http.Request) error {
+	ids := req.Header.Get("X-MHP-Hop-Ids")
+	if ids == "" {
+		// Only hoppers stamp, a request without identities starts a new path.
+		req.Header.Del("X-MHP-Hop-Path")
+	}
+	for _, id := range strings.Split(ids, ",") {
+		if id == h.identity {
+			return fmt.Errorf("request already went through %s", h.ServerName)
+		}
+	}
+	ttl := h.maxHops()
+	if received, err := strconv.Atoi(req.Header.Get("X-MHP-Hop-TTL")); err == nil && received < ttl {
+		ttl = received
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("request ran out of hops at %s", h.ServerName)
+	}
+	req.Header.Set("X-MHP-Hop-Ids", appendHop(ids, h.identity))
+	req.Header.Set("X-MHP-Hop-TTL", strconv.Itoa(ttl-1))
+	req.Header.Set("X-MHP-Hop-Path", appendHop(req.Header.Get("X-MHP-Hop-Path"), h.ServerName))
+	return nil
+}
+
+func (h *HopperServer) maxHops() int {
+	return orDefault(h.OutgoingHopProxy.serverOptions().MaxHops, defaultMaxHops)
+}
+
+// stampOrReject stamps req, answering 508 Loop Detected if that fails.
+func (h *HopperServer) stampOrReject(resp http.ResponseWriter, req *http.Request) bool {
+	if err := h.stamp(req); err != nil {
+		path := appendHop(req.Header.Get("X-MHP-Hop-Path"), h.ServerName)
+		h.warnLog.Printf("Loop detected for %v through %v: %v", req.Header.Get("X-MHP-Target-Host"), path, err)
+		resp.WriteHeader(http.StatusLoopDetected)
+		resp.Write([]byte("508 - Loop detected: " + err.Error() + ", path " + path))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,407 @@
+package minihyperproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// gossipPath is where incoming hop proxies of a mesh exchange what they know
+// of it.
+const gossipPath = "/.mhp/gossip"
+
+const (
+	defaultGossipInterval = time.Second
+	gossipTimeout         = 5 * time.Second
+	maxGossipSize         = 1 << 20
+)
+
+// MeshOptions make a hopper join the mesh of the hoppers reachable from
+// Seeds, the incoming hop URLs of some of them. Every GossipInterval, 1s by
+// default, a hopper swaps with a random peer what it knows of the mesh,
+// including the target hosts each hopper has incoming hops for, and peers
+// not heard of for PeerTimeout, ten intervals by default, are forgotten.
+// Hoppers then hop to every target host a peer advertises, through the peer
+// that answered the fastest, unless they have an outgoing or incoming hop of
+// their own for it. Advertise is the URL peers reach the hopper at, by
+// default its hostname and incoming port. Gossip needs HopSigning or PeerTLS.
+type MeshOptions struct {
+	Seeds          []string `json:"Seeds,omitempty" yaml:"Seeds,omitempty"`
+	Advertise      string   `json:"Advertise,omitempty" yaml:"Advertise,omitempty"`
+	GossipInterval string   `json:"GossipInterval,omitempty" yaml:"GossipInterval,omitempty"`
+	PeerTimeout    string   `json:"PeerTimeout,omitempty" yaml:"PeerTimeout,omitempty"`
+}
+
+type meshSettings struct {
+	seeds       []*url.URL
+	advertise   *url.URL
+	interval    time.Duration
+	peerTimeout time.Duration
+}
+
+func (o *MeshOptions) settings() (s *meshSettings, err error) {
+	s = &meshSettings{}
+	if s.interval, err = parseDuration("GossipInterval", o.GossipInterval, defaultGossipInterval); err != nil {
+		return nil, err
+	}
+	if s.peerTimeout, err = parseDuration("PeerTimeout", o.PeerTimeout, 10*s.interval); err != nil {
+		return nil, err
+	}
+	for _, seed := range o.Seeds {
+		hops, err := parseHopRoute(seed)
+		if err != nil || len(hops) != 1 {
+			return nil, fmt.Errorf("invalid seed %q", seed)
+		}
+		s.seeds = append(s.seeds, hops[0])
+	}
+	if o.Advertise != "" {
+		hops, err := parseHopRoute(o.Advertise)
+		if err != nil || len(hops) != 1 {
+			return nil, fmt.Errorf("invalid Advertise %q", o.Advertise)
+		}
+		s.advertise = hops[0]
+	}
+	return
+}
+
+// GossipPeer is what the mesh knows of a hopper. Heartbeat is the clock of
+// the hopper when it last gossiped, so that newer news of it win.
+type GossipPeer struct {
+	Address   string   `json:"Address"`
+	Name      string   `json:"Name"`
+	Identity  string   `json:"Identity"`
+	Heartbeat int64    `json:"Heartbeat"`
+	Hosts     []string `json:"Hosts,omitempty"`
+}
+
+// meshPeer is a peer as seen locally: when its heartbeat last rose, how fast
+// it answered this hopper, and whether it timed out, in which case it is
+// remembered for a while so that stale gossip does not bring it back.
+type meshPeer struct {
+	GossipPeer
+	seen time.Time
+	rtt  time.Duration
+	dead bool
+}
+
+type mesh struct {
+	settings *meshSettings
+	peers    map[string]*meshPeer
+	stop     func()
+	lock     sync.Mutex
+}
+
+func newMesh(settings *meshSettings) *mesh {
+	return &mesh{settings: settings, peers: make(map[string]*meshPeer)}
+}
+
+// merge takes in the news of peers other than self, and the time it took
+// from to answer, if this hopper gossiped with it.
+func (m *mesh) merge(peers []GossipPeer, self string, from string, rtt time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for _, p := range peers {
+		if p.Identity == self || p.Address == "" {
+			continue
+		}
+		known, ok := m.peers[p.Address]
+		if !ok {
+			known = &meshPeer{}
+			m.peers[p.Address] = known
+		} else if p.Heartbeat <= known.Heartbeat {
+			continue
+		}
+		known.GossipPeer, known.seen, known.dead = p, now, false
+	}
+	if known, ok := m.peers[from]; ok && rtt > 0 {
+		if known.rtt == 0 {
+			known.rtt = rtt
+		} else {
+			known.rtt = (4*known.rtt + rtt) / 5
+		}
+	}
+}
+
+// expire marks the peers not heard of for the peer timeout as dead, and
+// forgets them after three timeouts. It returns the peers that just died.
+func (m *mesh) expire(now time.Time) (died []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for address, p := range m.peers {
+		if age := now.Sub(p.seen); age > 3*m.settings.peerTimeout {
+			delete(m.peers, address)
+		} else if age > m.settings.peerTimeout && !p.dead {
+			p.dead = true
+			died = append(died, p.Name+" at "+address)
+		}
+	}
+	return
+}
+
+// alive lists the peers not timed out, by address.
+func (m *mesh) alive() []GossipPeer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	peers := make([]GossipPeer, 0, len(m.peers))
+	for _, p := range m.peers {
+		if !p.dead {
+			peers = append(peers, p.GossipPeer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// pick draws the peer to gossip with among the live peers and the seeds.
+func (m *mesh) pick(self string) string {
+	candidates := make(map[string]bool)
+	for _, seed := range m.settings.seeds {
+		candidates[seed.String()] = true
+	}
+	for _, p := range m.alive() {
+		candidates[p.Address] = true
+	}
+	delete(candidates, self)
+	addresses := make([]string, 0, len(candidates))
+	for address := range candidates {
+		addresses = append(addresses, address)
+	}
+	if len(addresses) == 0 {
+		return ""
+	}
+	sort.Strings(addresses)
+	return addresses[rand.Intn(len(addresses))]
+}
+
+// best picks a live peer for every target host advertised, keeping the
+// current one while it still advertises the host, and otherwise the fastest
+// one, peers this hopper never gossiped with coming last.
+func (m *mesh) best(current map[string]string) map[string]string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	candidates := make(map[string][]*meshPeer)
+	for _, p := range m.peers {
+		if !p.dead {
+			for _, host := range p.Hosts {
+				candidates[host] = append(candidates[host], p)
+			}
+		}
+	}
+	best := make(map[string]string, len(candidates))
+	for host, peers := range candidates {
+		sort.Slice(peers, func(i, j int) bool {
+			a, b := peers[i], peers[j]
+			if (a.rtt == 0) != (b.rtt == 0) {
+				return b.rtt == 0
+			} else if a.rtt != b.rtt {
+				return a.rtt < b.rtt
+			}
+			return a.Address < b.Address
+		})
+		best[host] = peers[0].Address
+		for _, p := range peers {
+			if p.Address == current[host] {
+				best[host] = p.Address
+			}
+		}
+	}
+	return best
+}
+
+func (h *HopperServer) getMesh() *mesh {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.mesh
+}
+
+// meshAddress is the URL peers reach h at.
+func (h *HopperServer) meshAddress(m *mesh) string {
+	if m.settings.advertise != nil {
+		return m.settings.advertise.String()
+	}
+	scheme := "http"
+	if h.OutgoingHopProxy.serverOptions().PeerTLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + h.Hostname + ":" + h.IncomingHopProxy.ServerPort
+}
+
+// gossipView is what h tells its peers: the live peers it knows of, and
+// itself along with the target hosts it has incoming hops for.
+func (h *HopperServer) gossipView(m *mesh) []GossipPeer {
+	incomingHops := h.getIncomingHops()
+	self := GossipPeer{Address: h.meshAddress(m), Name: h.ServerName, Identity: h.identity, Heartbeat: time.Now().UnixNano()}
+	for host := range incomingHops {
+		self.Hosts = append(self.Hosts, host)
+	}
+	sort.Strings(self.Hosts)
+	return append(m.alive(), self)
+}
+
+func gossipDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// gossip runs a round of gossip: h swaps views with a random peer, then
+// updates the hops it discovered.
+func (h *HopperServer) gossip(m *mesh) {
+	self := h.meshAddress(m)
+	if peer := m.pick(self); peer != "" {
+		start := time.Now()
+		if peers, err := h.exchange(peer, h.gossipView(m)); err == nil {
+			m.merge(peers, h.identity, peer, time.Since(start))
+		}
+	}
+	for _, peer := range m.expire(time.Now()) {
+		h.infoLog.Printf("Peer %s left the mesh", peer)
+	}
+	h.discover(m)
+}
+
+func (h *HopperServer) exchange(peer string, view []GossipPeer) (peers []GossipPeer, err error) {
+	body, _ := json.Marshal(view)
+	req, err := http.NewRequest(http.MethodPost, peer+gossipPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-MHP-Hop-Ids", h.identity)
+	req.Header.Set("X-MHP-Gossip-Digest", gossipDigest(body))
+	if signer := h.getSigner(); signer != nil {
+		signer.sign(req)
+	}
+	transport, _ := h.OutgoingHopProxy.upstreamTransport()
+	resp, err := (&http.Client{Transport: transport, Timeout: gossipTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s refused to gossip: %s", peer, resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxGossipSize)).Decode(&peers)
+	return
+}
+
+func (h *HopperServer) serveGossip(resp http.ResponseWriter, req *http.Request) {
+	m := h.getMesh()
+	if m == nil {
+		resp.WriteHeader(http.StatusNotFound)
+		resp.Write([]byte("404 - Not in a mesh"))
+		return
+	} else if !h.controlAllowed() {
+		resp.WriteHeader(http.StatusForbidden)
+		resp.Write([]byte("403 - Gossip needs HopSigning or PeerTLS"))
+		return
+	} else if req.Method != http.MethodPost {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxGossipSize))
+	peers := []GossipPeer{}
+	if err != nil || gossipDigest(body) != req.Header.Get("X-MHP-Gossip-Digest") || json.Unmarshal(body, &peers) != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte("400 - Invalid gossip"))
+		return
+	}
+	m.merge(peers, h.identity, "", 0)
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(h.gossipView(m))
+	h.discover(m)
+}
+
+// discover points the hops h discovered at the best peers for their target
+// hosts, and drops those no peer advertises anymore.
+func (h *HopperServer) discover(m *mesh) {
+	current := make(map[string]string)
+	h.lock.RLock()
+	for host := range h.discovered {
+		current[host] = h.OutgoingHopsReference[host].String()
+	}
+	h.lock.RUnlock()
+	best := m.best(current)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for host, peer := range best {
+		if _, ok := h.IncomingHopsReference[host]; ok {
+			continue
+		} else if _, ok := h.OutgoingHopsReference[host]; ok && (!h.discovered[host] || current[host] == peer) {
+			continue
+		}
+		hop, _ := url.Parse(peer)
+		h.infoLog.Printf("Discovered hop to %s through %v", host, hop)
+		h.OutgoingHopsReference[host] = hop
+		h.outgoingHopOptions[host] = HopOptions{}
+		h.outgoingTargets[host] = &url.URL{Scheme: "http", Host: host}
+		delete(h.hopBreakers, host)
+		h.discovered[host] = true
+	}
+	for host := range h.discovered {
+		_, advertised := best[host]
+		if _, served := h.IncomingHopsReference[host]; served || !advertised {
+			h.infoLog.Printf("Dropping discovered hop to %s", host)
+			delete(h.OutgoingHopsReference, host)
+			delete(h.outgoingHopOptions, host)
+			delete(h.outgoingTargets, host)
+			delete(h.discovered, host)
+		}
+	}
+}
+
+func (h *HopperServer) isDiscovered(host string) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.discovered[host]
+}
+
+func (h *HopperServer) startGossiping() {
+	m := h.getMesh()
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != nil {
+		return
+	}
+	done := make(chan struct{})
+	m.stop = func() { close(done) }
+	go func() {
+		ticker := time.NewTicker(m.settings.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				h.gossip(m)
+			}
+		}
+	}()
+}
+
+func (h *HopperServer) stopGossiping() {
+	m := h.getMesh()
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop != nil {
+		m.stop()
+		m.stop = nil
+	}
+}
@@ -0,0 +1,123 @@
+package minihyperproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMeshDiscovery(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	upstreamHost := upstreamURL.Hostname()
+	serviceURL, _ := url.Parse("http://service.example.com")
+
+	m := NewMinihyperProxy()
+	const size = 12
+	names := make([]string, size)
+	addresses := make(map[string]string)
+	outgoing := make(map[string]string)
+	hoppers := make(map[string]*HopperServer)
+	for i := range names {
+		names[i] = fmt.Sprintf("h%d", i)
+		// Every hopper only knows the previous one to start with.
+		mesh := &MeshOptions{GossipInterval: "20ms", PeerTimeout: "1s"}
+		if i > 0 {
+			mesh.Seeds = []string{addresses[names[i-1]]}
+		}
+		options := ServerOptions{HopSigning: &HopSigning{SharedKey: "s3cret"}, Mesh: mesh}
+		incomingPort, outgoingPort, _, httpErr := m.startHopperServer(names[i], "", "", "", options)
+		if httpErr != nil {
+			t.Fatalf("start %s: %v", names[i], httpErr)
+		}
+		defer m.removeServer(names[i])
+		addresses[names[i]] = "http://localhost:" + incomingPort
+		outgoing[names[i]] = outgoingPort
+		s, _ := m.server(names[i])
+		hoppers[names[i]] = (*s).(*HopperServer)
+	}
+	m.ReceiveHop("h3", upstreamURL, upstreamURL)
+	m.ReceiveHop("h7", upstreamURL, upstreamURL)
+	m.ReceiveHop("h5", serviceURL, serviceURL)
+
+	// hopsTo tells whether every hopper but the skipped ones hops to host
+	// through one of the peers.
+	hopsTo := func(host string, skip []string, peers ...string) bool {
+		for _, name := range names {
+			if contains(skip, name) {
+				continue
+			}
+			hop, ok := hoppers[name].outgoingHop(host)
+			if !ok {
+				return false
+			}
+			found := false
+			for _, peer := range peers {
+				found = found || hop.String() == addresses[peer]
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	waitFor(t, "the mesh to converge", func() bool {
+		for _, name := range names {
+			if len(hoppers[name].getMesh().alive()) != size-1 {
+				return false
+			}
+		}
+		return hopsTo(upstreamHost, []string{"h3", "h7"}, "h3", "h7") && hopsTo(serviceURL.Hostname(), []string{"h5"}, "h5")
+	})
+	if status, body := getBody(t, "http://localhost:"+outgoing["h0"]+"/"+upstreamHost+"/"); status != http.StatusOK || body != "ok" {
+		t.Errorf("discovered hop: expected 200 ok, got %d %q", status, body)
+	}
+	if peers := (*hoppers["h0"].Info())["Peers"].([]GossipPeer); peers[0].Name == "" || peers[0].Heartbeat == 0 {
+		t.Errorf("expected the peers of h0 in its info, got %+v", peers)
+	}
+	if hops := hoppers["h0"].exportConfig().OutgoingHops; len(hops) != 0 {
+		t.Errorf("discovered hops should not be exported, got %+v", hops)
+	}
+
+	// Manual hops win over discovered ones.
+	manual, _ := url.Parse(addresses["h2"])
+	m.AddHop("h1", serviceURL, manual, HopOptions{})
+	time.Sleep(100 * time.Millisecond)
+	if hop, _ := hoppers["h1"].outgoingHop(serviceURL.Hostname()); hop.String() != addresses["h2"] {
+		t.Errorf("manual hop replaced by %v", hop)
+	}
+
+	// Peers that leave are routed around once they time out.
+	m.removeServer("h3")
+	waitFor(t, "the hops to fail over to h7", func() bool {
+		return hopsTo(upstreamHost, []string{"h3", "h7"}, "h7")
+	})
+
+	// Hosts no longer advertised are dropped.
+	hoppers["h5"].deleteIncomingHop(serviceURL)
+	waitFor(t, "the service to be forgotten", func() bool {
+		for _, name := range names {
+			if _, ok := hoppers[name].outgoingHop(serviceURL.Hostname()); ok && name != "h1" && name != "h3" {
+				return false
+			}
+		}
+		return true
+	})
+
+	unsigned, _, _, _ := m.startHopperServer("unsigned", "", "", "", ServerOptions{Mesh: &MeshOptions{}})
+	defer m.removeServer("unsigned")
+	resp, err := http.Post("http://localhost:"+unsigned+gossipPath, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("gossip to a hopper unable to authenticate it: expected 403, got %d", resp.StatusCode)
+	}
+}
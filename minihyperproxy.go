@@ -4,26 +4,36 @@ import (
 	"log"
 	"net/url"
 	"os"
-	"strconv"
+	"sync"
 )
 
 type MinihyperProxy struct {
-	ErrorLog                   *log.Logger
-	WarnLog                    *log.Logger
-	InfoLog                    *log.Logger
-	latestHopperServerIncoming string
-	latestHopperServerOutgoing string
-	latestProxyServer          string
-	latestServer               string
-	Servers                    map[string]*Server
-	ServersNameReference       map[string]bool
+	ErrorLog   *log.Logger
+	WarnLog    *log.Logger
+	InfoLog    *log.Logger
+	Servers    map[string]*Server
+	Ports      *PortAllocator
+	store      *Store
+	configPath string
+	lastReload *ConfigDiff
+	lock       sync.RWMutex
+	reloadLock sync.Mutex
+	claimed    map[string]bool
+	journaling sync.RWMutex
 }
 
 func NewMinihyperProxy() (m *MinihyperProxy) {
 	m = &MinihyperProxy{ErrorLog: log.New(os.Stdout, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile),
 		WarnLog: log.New(os.Stdout, "WARN: ", log.Ldate|log.Ltime|log.Lshortfile),
 		InfoLog: log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile),
-		Servers: make(map[string]*Server)}
+		Servers: make(map[string]*Server),
+		Ports:   NewPortAllocator(),
+		claimed: make(map[string]bool)}
+	if stateDir := getEnv("MHP_STATE_DIR", ""); stateDir != "" {
+		if err := m.UseStore(stateDir); err != nil {
+			m.ErrorLog.Printf("Could not restore state from %s: %v", stateDir, err)
+		}
+	}
 	return
 }
 
@@ -34,26 +44,70 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func (m *MinihyperProxy) getFreeServerAndIncrement(referenceEnv string, referenceDefault string, increment bool) string {
-	var tempServer int
-	if m.latestServer != "" {
-		tempServer, _ = strconv.Atoi(m.latestServer)
-		tempServer++
-	} else {
-		tempServer, _ = strconv.Atoi(getEnv(referenceEnv, referenceDefault))
+func (m *MinihyperProxy) server(serverName string) (s *Server, ok bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	s, ok = m.Servers[serverName]
+	return
+}
+
+func (m *MinihyperProxy) serverList() map[string]*Server {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	servers := make(map[string]*Server, len(m.Servers))
+	for name, s := range m.Servers {
+		servers[name] = s
 	}
-	serverPort := strconv.Itoa(tempServer)
+	return servers
+}
 
-	if increment {
-		m.latestServer = serverPort
+// claimName keeps serverName taken while its server is being started, so two
+// concurrent creations cannot both succeed.
+func (m *MinihyperProxy) claimName(serverName string) *HttpError {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.Servers[serverName]; ok || m.claimed[serverName] {
+		return ServerNameAlreadyExistsError
 	}
-	return serverPort
+	m.claimed[serverName] = true
+	return nil
 }
 
-func (m *MinihyperProxy) AddHop(serverName string, target *url.URL, hop *url.URL) (httpErr *HttpError) {
-	if s, ok := m.Servers[serverName]; ok {
+// registerServer releases the claim on serverName, registering s under it
+// unless s is nil. Servers are registered before they are journaled, so that
+// a compaction triggered by their record exports them.
+func (m *MinihyperProxy) registerServer(serverName string, s *Server) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.claimed, serverName)
+	if s != nil {
+		m.Servers[serverName] = s
+	}
+}
+
+func (m *MinihyperProxy) AddHop(serverName string, target *url.URL, hop *url.URL, options HopOptions) (httpErr *HttpError) {
+	return m.addHop(serverName, target, hop, options, false)
+}
+
+// addHop adds a hop, registering it in the background when restoring, as
+// the remote hoppers may not be up yet.
+func (m *MinihyperProxy) addHop(serverName string, target *url.URL, hop *url.URL, options HopOptions, restoring bool) (httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
 		if hopperServer, ok := (*s).(*HopperServer); ok {
-			hopperServer.BuildNewOutgoingHop(target, hop)
+			build := hopperServer.BuildNewOutgoingHop
+			if restoring {
+				build = hopperServer.restoreOutgoingHop
+			}
+			if err := build(target, hop, options); err != nil {
+				if _, ok := err.(*registrationError); ok {
+					httpErr = newHopRegistrationError(err)
+				} else {
+					httpErr = newInvalidHopError(err)
+				}
+			} else {
+				m.record(StoreRecord{Op: OpAddHop, Name: serverName, Target: target.String(), Hop: hop.String(), HopOptions: &options})
+			}
 		} else {
 			httpErr = WrongServerTypeError
 		}
@@ -64,9 +118,47 @@ func (m *MinihyperProxy) AddHop(serverName string, target *url.URL, hop *url.URL
 }
 
 func (m *MinihyperProxy) ReceiveHop(serverName string, target *url.URL, hop *url.URL) (httpErr *HttpError) {
-	if s, ok := m.Servers[serverName]; ok {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
 		if hopperServer, ok := (*s).(*HopperServer); ok {
 			hopperServer.BuildNewIncomingHop(target, hop)
+			m.record(StoreRecord{Op: OpReceiveHop, Name: serverName, Target: target.String()})
+		} else {
+			httpErr = WrongServerTypeError
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
+
+func (m *MinihyperProxy) RemoveHop(serverName string, target *url.URL) (httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
+		if hopperServer, ok := (*s).(*HopperServer); ok {
+			if hopperServer.deleteOutgoingHop(target) {
+				m.record(StoreRecord{Op: OpRemoveHop, Name: serverName, Target: target.String()})
+			} else {
+				httpErr = NoHopFoundError
+			}
+		} else {
+			httpErr = WrongServerTypeError
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
+
+func (m *MinihyperProxy) RemoveReceivedHop(serverName string, target *url.URL) (httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
+		if hopperServer, ok := (*s).(*HopperServer); ok {
+			if hopperServer.deleteIncomingHop(target) {
+				m.record(StoreRecord{Op: OpRemoveReceivedHop, Name: serverName, Target: target.String()})
+			} else {
+				httpErr = NoHopFoundError
+			}
 		} else {
 			httpErr = WrongServerTypeError
 		}
@@ -77,7 +169,7 @@ func (m *MinihyperProxy) ReceiveHop(serverName string, target *url.URL, hop *url
 }
 
 func (m *MinihyperProxy) GetOutgoingHops(serverName string) (hops map[string]*url.URL, httpErr *HttpError) {
-	if s, ok := m.Servers[serverName]; ok {
+	if s, ok := m.server(serverName); ok {
 		if hopperServer, ok := (*s).(*HopperServer); ok {
 			hops = hopperServer.getOutgoingHops()
 		} else {
@@ -89,8 +181,21 @@ func (m *MinihyperProxy) GetOutgoingHops(serverName string) (hops map[string]*ur
 	return
 }
 
+func (m *MinihyperProxy) GetHopBreakers(serverName string) (breakers map[string]*BreakerStats, httpErr *HttpError) {
+	if s, ok := m.server(serverName); ok {
+		if hopperServer, ok := (*s).(*HopperServer); ok {
+			breakers = hopperServer.getHopBreakers()
+		} else {
+			httpErr = WrongServerTypeError
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
+
 func (m *MinihyperProxy) GetIncomingHops(serverName string) (hops map[string]*url.URL, httpErr *HttpError) {
-	if s, ok := m.Servers[serverName]; ok {
+	if s, ok := m.server(serverName); ok {
 		if hopperServer, ok := (*s).(*HopperServer); ok {
 			hops = hopperServer.getIncomingHops()
 		} else {
@@ -103,7 +208,7 @@ func (m *MinihyperProxy) GetIncomingHops(serverName string) (hops map[string]*ur
 }
 
 func (m *MinihyperProxy) GetProxyMap(serverName string) (proxyMap map[string]string, httpErr *HttpError) {
-	if s, ok := m.Servers[serverName]; ok {
+	if s, ok := m.server(serverName); ok {
 		if proxyServer, ok := (*s).(*ProxyServer); ok {
 			proxyMap = proxyServer.getProxyMap()
 		} else {
@@ -115,14 +220,63 @@ func (m *MinihyperProxy) GetProxyMap(serverName string) (proxyMap map[string]str
 	return
 }
 
-func (m *MinihyperProxy) startHopperServer(serverName string, hostname string) (incomingPort, outgoingPort, finalHostname string, httpErr *HttpError) {
+func (m *MinihyperProxy) GetRoutes(serverName string) (routes []RouteInfo, httpErr *HttpError) {
+	if s, ok := m.server(serverName); ok {
+		if proxyServer, ok := (*s).(*ProxyServer); ok {
+			routes = proxyServer.getRoutes()
+		} else {
+			httpErr = WrongServerTypeError
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
 
-	if serverName == "" {
-		httpErr = EmptyFieldError
+func (m *MinihyperProxy) GetHealth(serverName string) (health map[string][]UpstreamStats, httpErr *HttpError) {
+	if s, ok := m.server(serverName); ok {
+		if proxyServer, ok := (*s).(*ProxyServer); ok {
+			health = proxyServer.getHealth()
+		} else {
+			httpErr = WrongServerTypeError
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
+
+// SetTLS swaps the certificates and TLS policy of a proxy created with TLS,
+// without restarting its listener.
+func (m *MinihyperProxy) SetTLS(serverName string, options TLSOptions) (certificates []CertificateInfo, httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
+		if proxyServer, ok := (*s).(*ProxyServer); ok {
+			if err := proxyServer.setTLS(&options); err != nil {
+				httpErr = newInvalidOptionsError(err)
+			} else {
+				certificates = certificatesInfo(proxyServer.currentTLSConfig())
+				m.record(StoreRecord{Op: OpSetTLS, Name: serverName, ServerOptions: &ServerOptions{TLS: &options}})
+			}
+		} else {
+			httpErr = WrongServerTypeError
+		}
+	} else {
+		httpErr = NoServerFoundError
 	}
+	return
+}
 
-	if _, ok := m.Servers[serverName]; ok {
-		httpErr = ServerNameAlreadyExistsError
+func (m *MinihyperProxy) startHopperServer(serverName string, hostname string, requestedIncomingPort string, requestedOutgoingPort string, options ServerOptions) (incomingPort, outgoingPort, finalHostname string, httpErr *HttpError) {
+	defer m.mutation()()
+	if serverName == "" {
+		httpErr = EmptyFieldError
+	} else if _, err := options.settings(); err != nil {
+		httpErr = newInvalidOptionsError(err)
+	} else if options.TLS != nil {
+		httpErr = newInvalidOptionsError(errHopperTLS)
+	} else {
+		httpErr = m.claimName(serverName)
 	}
 
 	if hostname == "" {
@@ -130,37 +284,40 @@ func (m *MinihyperProxy) startHopperServer(serverName string, hostname string) (
 	}
 
 	if httpErr == nil {
-		incomingPort = m.getFreeServerAndIncrement("HOPPER_SERVER_INCOMING", "7053", false)
-		outgoingPort = m.getFreeServerAndIncrement("HOPPER_SERVER_OUTGOING", "7054", false)
-
-		fullIncomingServerName := hostname + ":" + incomingPort
-		fullOutgoingServerName := hostname + ":" + outgoingPort
-
-		if m.ServersNameReference[fullIncomingServerName] || m.ServersNameReference[fullOutgoingServerName] {
-			httpErr = ServerHostnamePortTakenError
-		} else {
-			finalHostname = hostname
-			m.getFreeServerAndIncrement("HOPPER_SERVER_INCOMING", "7053", true)
-			m.getFreeServerAndIncrement("HOPPER_SERVER_OUTGOING", "7054", true)
-			m.latestHopperServerIncoming = incomingPort
-			m.latestHopperServerOutgoing = outgoingPort
-			tempServer := Server(NewHopperServer(serverName, hostname, m.latestHopperServerIncoming, m.latestHopperServerOutgoing))
-			m.Servers[serverName] = &tempServer
-			(*m.Servers[serverName]).Serve()
-
+		var ports []string
+		defer func() {
+			if httpErr != nil {
+				m.registerServer(serverName, nil)
+			}
+		}()
+		if ports, httpErr = m.Ports.acquire(HopperPorts, hostname, requestedIncomingPort, requestedOutgoingPort); httpErr == nil {
+			incomingPort, outgoingPort = ports[0], ports[1]
+			hopperServer := NewHopperServer(serverName, hostname, incomingPort, outgoingPort)
+			hopperServer.configure(options)
+			tempServer := Server(hopperServer)
+			if err := tempServer.Serve(); err != nil {
+				m.Ports.Release(hostname, ports...)
+				httpErr = newServerBindError(err)
+			} else {
+				finalHostname = hostname
+				m.registerServer(serverName, &tempServer)
+				m.record(StoreRecord{Op: OpCreateHopper, Name: serverName, Hostname: hostname, Ports: ports, ServerOptions: &options})
+			}
 		}
 	}
 	return
 }
 
-func (m *MinihyperProxy) startProxyServer(serverName string, hostname string) (proxyPort, finalHostname string, httpErr *HttpError) {
-
+func (m *MinihyperProxy) startProxyServer(serverName string, hostname string, requestedPort string, options ServerOptions) (proxyPort, finalHostname string, httpErr *HttpError) {
+	defer m.mutation()()
 	if serverName == "" {
 		httpErr = EmptyFieldError
-	}
-
-	if _, ok := m.Servers[serverName]; ok {
-		httpErr = ServerNameAlreadyExistsError
+	} else if _, err := options.settings(); err != nil {
+		httpErr = newInvalidOptionsError(err)
+	} else if err := options.hopperOnly(); err != nil {
+		httpErr = newInvalidOptionsError(err)
+	} else {
+		httpErr = m.claimName(serverName)
 	}
 
 	if hostname == "" {
@@ -168,28 +325,84 @@ func (m *MinihyperProxy) startProxyServer(serverName string, hostname string) (p
 	}
 
 	if httpErr == nil {
-		proxyPort = m.getFreeServerAndIncrement("PROXY_SERVER", "7053", false)
-		fullServerName := hostname + ":" + proxyPort
+		var ports []string
+		defer func() {
+			if httpErr != nil {
+				m.registerServer(serverName, nil)
+			}
+		}()
+		if ports, httpErr = m.Ports.acquire(ProxyPorts, hostname, requestedPort); httpErr == nil {
+			proxyPort = ports[0]
+			proxyServer := NewProxyServer(serverName, hostname, proxyPort)
+			proxyServer.configure(options)
+			tempServer := Server(proxyServer)
+			if err := tempServer.Serve(); err != nil {
+				m.Ports.Release(hostname, ports...)
+				httpErr = newServerBindError(err)
+			} else {
+				finalHostname = hostname
+				m.registerServer(serverName, &tempServer)
+				m.record(StoreRecord{Op: OpCreateProxy, Name: serverName, Hostname: hostname, Ports: ports, ServerOptions: &options})
+			}
+		}
+	}
+	return
+}
 
-		if m.ServersNameReference[fullServerName] {
-			httpErr = ServerHostnamePortTakenError
+func (m *MinihyperProxy) addProxyRedirect(serverName string, route string, target *url.URL, options RouteOptions) (httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
+		if proxyServer, ok := (*s).(*ProxyServer); ok {
+			if err := proxyServer.NewProxy(route, target, options); err != nil {
+				httpErr = newInvalidRouteError(err)
+			} else {
+				record := StoreRecord{Op: OpCreateRoute, Name: serverName, Route: route, Options: &options}
+				if target != nil {
+					record.Target = target.String()
+				}
+				m.record(record)
+			}
 		} else {
-			finalHostname = hostname
-			m.getFreeServerAndIncrement("PROXY_SERVER", "7053", true)
-			m.latestProxyServer = proxyPort
-			tempServer := Server(NewProxyServer(serverName, hostname, m.latestProxyServer))
-
-			m.Servers[serverName] = &tempServer
-			(*m.Servers[serverName]).Serve()
+			httpErr = WrongServerTypeError
 		}
+	} else {
+		httpErr = NoServerFoundError
 	}
 	return
 }
 
-func (m *MinihyperProxy) addProxyRedirect(serverName string, path *url.URL, target *url.URL) (httpErr *HttpError) {
-	if s, ok := m.Servers[serverName]; ok {
+func (m *MinihyperProxy) removeProxyRedirect(serverName string, route string, conditions RouteConditions) (httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
 		if proxyServer, ok := (*s).(*ProxyServer); ok {
-			proxyServer.NewProxy(&url.URL{Path: path.EscapedPath()}, target)
+			if proxyServer.DeleteProxy(routeKey(route, conditions)) {
+				m.record(StoreRecord{Op: OpRemoveRoute, Name: serverName, Route: route, Options: &RouteOptions{RouteConditions: conditions}})
+			} else {
+				httpErr = NoRouteFoundError
+			}
+		} else {
+			httpErr = WrongServerTypeError
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
+
+func serverPorts(s Server) (hostname string, ports []string) {
+	switch server := s.(type) {
+	case *ProxyServer:
+		return server.Hostname, []string{server.ServerPort}
+	case *HopperServer:
+		return server.Hostname, []string{server.IncomingHopProxy.ServerPort, server.OutgoingHopProxy.ServerPort}
+	}
+	return
+}
+
+func (m *MinihyperProxy) deleteServer(serverName string, serverType string) (httpErr *HttpError) {
+	if s, ok := m.server(serverName); ok {
+		if (*(*s).Info())["Type"] == serverType {
+			httpErr = m.removeServer(serverName)
 		} else {
 			httpErr = WrongServerTypeError
 		}
@@ -199,15 +412,76 @@ func (m *MinihyperProxy) addProxyRedirect(serverName string, path *url.URL, targ
 	return
 }
 
-func (m *MinihyperProxy) stopServer(serverName string) {
-	if s, ok := m.Servers[serverName]; ok {
-		m.InfoLog.Printf("Stopping %s", serverName)
-		(*s).Stop()
+func (m *MinihyperProxy) removeServer(serverName string) (httpErr *HttpError) {
+	defer m.mutation()()
+	m.lock.Lock()
+	s, ok := m.Servers[serverName]
+	delete(m.Servers, serverName)
+	m.lock.Unlock()
+
+	if ok {
+		m.InfoLog.Printf("Removing %s", serverName)
+		if (*(*s).Info())["Status"] != StatusDown {
+			(*s).Stop()
+		}
+		hostname, ports := serverPorts(*s)
+		m.Ports.Release(hostname, ports...)
+		m.record(StoreRecord{Op: OpRemoveServer, Name: serverName})
+	} else {
+		httpErr = NoServerFoundError
 	}
+	return
+}
+
+func (m *MinihyperProxy) stopServer(serverName string) (httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
+		if (*(*s).Info())["Status"] == StatusDown {
+			httpErr = ServerAlreadyStoppedError
+		} else {
+			m.InfoLog.Printf("Stopping %s", serverName)
+			(*s).Stop()
+			m.record(StoreRecord{Op: OpStopServer, Name: serverName})
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
+
+func (m *MinihyperProxy) startServer(serverName string) (httpErr *HttpError) {
+	defer m.mutation()()
+	if s, ok := m.server(serverName); ok {
+		if status := (*(*s).Info())["Status"]; status == StatusUp || status == StatusStarting {
+			httpErr = ServerAlreadyRunningError
+		} else {
+			m.InfoLog.Printf("Starting %s", serverName)
+			if err := (*s).Serve(); err != nil {
+				httpErr = newServerBindError(err)
+			} else {
+				m.record(StoreRecord{Op: OpStartServer, Name: serverName})
+			}
+		}
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
+}
+
+func (m *MinihyperProxy) restartServer(serverName string) (httpErr *HttpError) {
+	if s, ok := m.server(serverName); ok {
+		if (*(*s).Info())["Status"] != StatusDown {
+			m.stopServer(serverName)
+		}
+		httpErr = m.startServer(serverName)
+	} else {
+		httpErr = NoServerFoundError
+	}
+	return
 }
 
 func (m *MinihyperProxy) GetServersInfo() (serversInfo []ServerInfo) {
-	for _, s := range m.Servers {
+	for _, s := range m.serverList() {
 		newServerInfo := (*s).Info()
 		serversInfo = append(serversInfo, newServerInfo)
 	}
@@ -215,7 +489,7 @@ func (m *MinihyperProxy) GetServersInfo() (serversInfo []ServerInfo) {
 }
 
 func (m *MinihyperProxy) GetProxiesInfo() (serversInfo []ServerInfo) {
-	for _, s := range m.Servers {
+	for _, s := range m.serverList() {
 		newServerInfo := (*s).Info()
 		if (*newServerInfo)["Type"] != "Proxy" {
 			continue
@@ -227,7 +501,7 @@ func (m *MinihyperProxy) GetProxiesInfo() (serversInfo []ServerInfo) {
 
 func (m *MinihyperProxy) GetProxyInfo(Name string) (serverInfo ServerInfo, httpErr *HttpError) {
 
-	if s, ok := m.Servers[Name]; ok {
+	if s, ok := m.server(Name); ok {
 		newServerInfo := (*s).Info()
 		if (*newServerInfo)["Type"] == "Proxy" {
 			serverInfo = (*s).Info()
@@ -241,7 +515,7 @@ func (m *MinihyperProxy) GetProxyInfo(Name string) (serverInfo ServerInfo, httpE
 }
 
 func (m *MinihyperProxy) GetHoppersInfo() (serversInfo []ServerInfo) {
-	for _, s := range m.Servers {
+	for _, s := range m.serverList() {
 		newServerInfo := (*s).Info()
 		if (*newServerInfo)["Type"] != "Hopper" {
 			continue
@@ -252,7 +526,7 @@ func (m *MinihyperProxy) GetHoppersInfo() (serversInfo []ServerInfo) {
 }
 
 func (m *MinihyperProxy) GetHopperInfo(Name string) (serverInfo ServerInfo, httpErr *HttpError) {
-	if s, ok := m.Servers[Name]; ok {
+	if s, ok := m.server(Name); ok {
 		newServerInfo := (*s).Info()
 		if (*newServerInfo)["Type"] == "Hopper" {
 			serverInfo = (*s).Info()
@@ -266,12 +540,10 @@ func (m *MinihyperProxy) GetHopperInfo(Name string) (serverInfo ServerInfo, http
 }
 
 func (m *MinihyperProxy) GetServerInfo(Name string) (serverInfo ServerInfo, httpErr *HttpError) {
-	if s, ok := m.Servers[Name]; ok {
+	if s, ok := m.server(Name); ok {
 		serverInfo = (*s).Info()
 	} else {
 		httpErr = NoServerFoundError
 	}
 	return
 }
-
-func (m *MinihyperProxy) importConfig() {}
@@ -16,9 +16,9 @@ func TestGenerale(t *testing.T) {
 
 	m := NewMinihyperProxy()
 
-	m.startHopperServer("prova", "")
-	m.startHopperServer("prova2", "")
-	m.AddHop("prova", &url.URL{Host: "www.google.com", Scheme: "http"}, &url.URL{Host: "localhost:7055", Scheme: "http"})
+	m.startHopperServer("prova", "", "", "", ServerOptions{})
+	m.startHopperServer("prova2", "", "", "", ServerOptions{})
+	m.AddHop("prova", &url.URL{Host: "www.google.com", Scheme: "http"}, &url.URL{Host: "localhost:7055", Scheme: "http"}, HopOptions{})
 	m.ReceiveHop("prova2", &url.URL{Host: "www.google.com", Scheme: "http"}, &url.URL{Host: "localhost:7055", Scheme: "http"})
 	//target, err := url.Parse("https://google.com/")
 
@@ -44,3 +44,21 @@ func TestGenerale(t *testing.T) {
 	m.stopServer("prova")
 	m.stopServer("prova2")
 }
+
+func TestListenerFailure(t *testing.T) {
+	m := NewMinihyperProxy()
+	port, _, httpErr := m.startProxyServer("api", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("api")
+	s, _ := m.server("api")
+	(*s).(*ProxyServer).listener.Close()
+	waitFor(t, "the listener failure to be reported", func() bool {
+		info, _ := m.GetProxyInfo("api")
+		return (*info)["Status"] == StatusFailed
+	})
+	if _, err := http.Get("http://localhost:" + port); err == nil {
+		t.Errorf("expected the closed listener to refuse connections")
+	}
+}
@@ -0,0 +1,73 @@
+package minihyperproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// PeerTLSOptions secure the hops between hoppers with mutual TLS. Certificate
+// is served by the incoming hop proxy and presented as a client certificate
+// by the outgoing one, whose hops must use https. Peers must present a
+// certificate signed by the CA, as PEM file or inline, and named in
+// AllowedPeers by their common name or one of their DNS names, unless
+// AllowedPeers is empty.
+type PeerTLSOptions struct {
+	Certificate  TLSCertificate `json:"Certificate" yaml:"Certificate"`
+	CAFile       string         `json:"CAFile,omitempty" yaml:"CAFile,omitempty"`
+	CAPEM        string         `json:"CAPEM,omitempty" yaml:"CAPEM,omitempty"`
+	AllowedPeers []string       `json:"AllowedPeers,omitempty" yaml:"AllowedPeers,omitempty"`
+}
+
+// configs builds the tls.Config of the incoming hop proxy listener and the
+// one of the outgoing hop proxy client.
+func (o *PeerTLSOptions) configs() (server *tls.Config, client *tls.Config, err error) {
+	cert, err := o.Certificate.load()
+	if err != nil {
+		return nil, nil, fmt.Errorf("peer certificate: %v", err)
+	}
+	pool, err := loadCAPool(o.CAFile, o.CAPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("peer CA: %v", err)
+	}
+	allowed := make(map[string]bool, len(o.AllowedPeers))
+	for _, peer := range o.AllowedPeers {
+		allowed[peer] = true
+	}
+	server = &tls.Config{MinVersion: tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(allowed) == 0 {
+				return nil
+			}
+			leaf := chains[0][0]
+			if allowed[leaf.Subject.CommonName] {
+				return nil
+			}
+			for _, name := range leaf.DNSNames {
+				if allowed[name] {
+					return nil
+				}
+			}
+			return fmt.Errorf("peer %s is not allowed", leaf.Subject.CommonName)
+		}}
+	client = &tls.Config{MinVersion: tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool}
+	return
+}
+
+// setClientTLS makes the upstream transport of s present config.
+func (s *ProxyServer) setClientTLS(config *tls.Config) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if s.upstream != nil {
+		transport = s.upstream.transport()
+	}
+	transport.TLSClientConfig = config
+	s.transport = transport
+}
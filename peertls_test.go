@@ -0,0 +1,80 @@
+package minihyperproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHopperPeerTLS(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	ca, otherCA := newTestCA(t, "mesh"), newTestCA(t, "other")
+	m := NewMinihyperProxy()
+	startHopper := func(name string, options *PeerTLSOptions) (string, string) {
+		incomingPort, outgoingPort, _, httpErr := m.startHopperServer(name, "", "", "", ServerOptions{PeerTLS: options})
+		if httpErr != nil {
+			t.Fatalf("start %s: %v", name, httpErr)
+		}
+		return incomingPort, outgoingPort
+	}
+	coreIncoming, _ := startHopper("core", &PeerTLSOptions{Certificate: ca.issue(t, "core"), CAPEM: ca.CAPEM, AllowedPeers: []string{"edge"}})
+	defer m.removeServer("core")
+	m.ReceiveHop("core", upstreamURL, upstreamURL)
+	coreURL := &url.URL{Scheme: "https", Host: "localhost:" + coreIncoming}
+
+	for _, peer := range []struct {
+		name    string
+		options *PeerTLSOptions
+		status  int
+	}{
+		{"edge", &PeerTLSOptions{Certificate: ca.issue(t, "edge"), CAPEM: ca.CAPEM}, http.StatusOK},
+		{"rogue", &PeerTLSOptions{Certificate: ca.issue(t, "rogue"), CAPEM: ca.CAPEM}, http.StatusBadGateway},
+		{"stranger", &PeerTLSOptions{Certificate: otherCA.issue(t, "edge"), CAPEM: ca.CAPEM}, http.StatusBadGateway},
+		{"plain", nil, http.StatusBadGateway},
+	} {
+		_, outgoingPort := startHopper(peer.name, peer.options)
+		defer m.removeServer(peer.name)
+		m.AddHop(peer.name, upstreamURL, coreURL, HopOptions{})
+		status, body := getBody(t, "http://localhost:"+outgoingPort+"/"+upstreamURL.Hostname()+"/")
+		if status != peer.status || (status == http.StatusOK && body != "ok") {
+			t.Errorf("%s: expected %d, got %d %s", peer.name, peer.status, status, body)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(ca.CAPEM))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := client.Get(coreURL.String()); err == nil {
+		resp.Body.Close()
+		t.Errorf("incoming hop proxy accepted a client without certificate")
+	}
+
+	api := BuildAPI(m)
+	servers := ListServersResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/hopper", `{"Name": "core"}`).Body.Bytes(), &servers)
+	if info, _ := json.Marshal(servers.Info[0]); strings.Contains(string(info), "PRIVATE KEY") || !strings.Contains(string(info), "AllowedPeers") {
+		t.Errorf("hopper info leaks keys or misses PeerTLS: %s", info)
+	}
+	edge := ca.issue(t, "edge")
+	for _, bad := range []string{
+		`{"Name": "bad", "PeerTLS": {"CAPEM": ` + jsonString(ca.CAPEM) + `}}`,
+		`{"Name": "bad", "PeerTLS": {"Certificate": {"CertPEM": ` + jsonString(edge.CertPEM) + `, "KeyPEM": ` + jsonString(edge.KeyPEM) + `}}}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/hopper", bad); resp.Code != 422 {
+			t.Errorf("expected 422 for %s, got %d", bad, resp.Code)
+		}
+	}
+	if resp := callAPI(t, api, "POST", "/proxy", `{"Name": "bad", "PeerTLS": {"Certificate": {"CertPEM": `+jsonString(edge.CertPEM)+`, "KeyPEM": `+jsonString(edge.KeyPEM)+`}, "CAPEM": `+jsonString(ca.CAPEM)+`}}`); resp.Code != 422 {
+		t.Errorf("PeerTLS on a proxy: expected 422, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,275 @@
+package minihyperproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancers an UpstreamPool can pick its targets with.
+const (
+	BalanceRoundRobin         = "RoundRobin"
+	BalanceWeightedRoundRobin = "WeightedRoundRobin"
+	BalanceLeastConnections   = "LeastConnections"
+	BalanceRandomTwoChoices   = "RandomTwoChoices"
+	BalanceConsistentHash     = "ConsistentHash"
+)
+
+const hashReplicas = 100
+
+type PoolTarget struct {
+	URL    string `json:"URL" yaml:"URL"`
+	Weight int    `json:"Weight,omitempty" yaml:"Weight,omitempty"`
+}
+
+// Upstream is a target of an UpstreamPool along with its counters.
+type Upstream struct {
+	URL                 *url.URL
+	Weight              int
+	active              int64
+	requests            uint64
+	failures            uint64
+	consecutiveFailures int64
+	ejectedUntil        int64
+	ejections           uint64
+	unhealthy           int32
+	lastCheckError      atomic.Value
+	currentWeight       int
+}
+
+type UpstreamStats struct {
+	Target         string `json:"Target"`
+	Weight         int    `json:"Weight"`
+	Healthy        bool   `json:"Healthy"`
+	Ejected        bool   `json:"Ejected"`
+	Ejections      uint64 `json:"Ejections"`
+	LastCheckError string `json:"LastCheckError,omitempty"`
+	Active         int64  `json:"Active"`
+	Requests       uint64 `json:"Requests"`
+	Failures       uint64 `json:"Failures"`
+}
+
+type hashPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// UpstreamPool spreads the requests of a route over its targets. HashOn tells
+// ConsistentHash what to hash: IP, Header:<name> or Cookie:<name>. Requests
+// without it fall back to round-robin.
+type UpstreamPool struct {
+	Balancer    string
+	HashOn      string
+	upstreams   []*Upstream
+	ring        []hashPoint
+	next        uint64
+	random      *rand.Rand
+	healthCheck *healthSettings
+	outlier     *outlierSettings
+	stopChecks  func()
+	transport   http.RoundTripper
+	lock        sync.Mutex
+}
+
+func validateHashOn(hashOn string) error {
+	kind := strings.SplitN(hashOn, ":", 2)
+	switch {
+	case hashOn == "IP":
+		return nil
+	case len(kind) == 2 && (kind[0] == "Header" || kind[0] == "Cookie") && kind[1] != "":
+		return nil
+	}
+	return fmt.Errorf("invalid HashOn %q, expected IP, Header:<name> or Cookie:<name>", hashOn)
+}
+
+func newUpstreamPool(targets []PoolTarget, balancer string, hashOn string) (*UpstreamPool, error) {
+	if balancer == "" {
+		balancer = BalanceRoundRobin
+	}
+	switch balancer {
+	case BalanceRoundRobin, BalanceWeightedRoundRobin, BalanceLeastConnections, BalanceRandomTwoChoices:
+	case BalanceConsistentHash:
+		if err := validateHashOn(hashOn); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown Balancer %q", balancer)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no target")
+	}
+
+	p := &UpstreamPool{Balancer: balancer, HashOn: hashOn, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, target := range targets {
+		targetURL, err := url.Parse(target.URL)
+		if err != nil || targetURL.Scheme == "" || targetURL.Host == "" {
+			return nil, fmt.Errorf("invalid target %q", target.URL)
+		}
+		if target.Weight < 0 {
+			return nil, fmt.Errorf("negative weight for target %q", target.URL)
+		}
+		weight := target.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		p.upstreams = append(p.upstreams, &Upstream{URL: targetURL, Weight: weight})
+	}
+	if balancer == BalanceConsistentHash {
+		for _, u := range p.upstreams {
+			for i := 0; i < hashReplicas*u.Weight; i++ {
+				p.ring = append(p.ring, hashPoint{hash: hashString(u.URL.String() + "#" + strconv.Itoa(i)), upstream: u})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return p, nil
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (p *UpstreamPool) hashKey(req *http.Request) string {
+	if p.HashOn == "IP" {
+		return hostWithoutPort(req.RemoteAddr)
+	}
+	kind := strings.SplitN(p.HashOn, ":", 2)
+	if kind[0] == "Header" {
+		return req.Header.Get(kind[1])
+	}
+	if cookie, err := req.Cookie(kind[1]); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func (p *UpstreamPool) roundRobin(upstreams []*Upstream) *Upstream {
+	next := atomic.AddUint64(&p.next, 1) - 1
+	return upstreams[next%uint64(len(upstreams))]
+}
+
+// available lists the upstreams in rotation, but the excluded ones.
+func (p *UpstreamPool) available(exclude []*Upstream) []*Upstream {
+	now := time.Now()
+	upstreams := make([]*Upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.available(now) && !hasUpstream(exclude, u) {
+			upstreams = append(upstreams, u)
+		}
+	}
+	return upstreams
+}
+
+func hasUpstream(upstreams []*Upstream, u *Upstream) bool {
+	for _, candidate := range upstreams {
+		if candidate == u {
+			return true
+		}
+	}
+	return false
+}
+
+// pick chooses the upstream req goes to among the ones in rotation, nil if
+// none is. It avoids the upstreams already tried unless they are the only
+// ones left.
+func (p *UpstreamPool) pick(req *http.Request, tried ...*Upstream) *Upstream {
+	upstreams := p.available(tried)
+	if len(upstreams) == 0 && len(tried) > 0 {
+		upstreams = p.available(nil)
+	}
+	switch len(upstreams) {
+	case 0:
+		return nil
+	case 1:
+		return upstreams[0]
+	}
+	switch p.Balancer {
+	case BalanceWeightedRoundRobin:
+		// Smooth weighted round-robin, as in nginx: heavier targets are
+		// picked more often without being picked in bursts.
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		var best *Upstream
+		total := 0
+		for _, u := range upstreams {
+			u.currentWeight += u.Weight
+			total += u.Weight
+			if best == nil || u.currentWeight > best.currentWeight {
+				best = u
+			}
+		}
+		best.currentWeight -= total
+		return best
+	case BalanceLeastConnections:
+		start := atomic.AddUint64(&p.next, 1)
+		var best *Upstream
+		for i := range upstreams {
+			u := upstreams[(start+uint64(i))%uint64(len(upstreams))]
+			if best == nil || atomic.LoadInt64(&u.active) < atomic.LoadInt64(&best.active) {
+				best = u
+			}
+		}
+		return best
+	case BalanceRandomTwoChoices:
+		p.lock.Lock()
+		first := p.random.Intn(len(upstreams))
+		second := (first + 1 + p.random.Intn(len(upstreams)-1)) % len(upstreams)
+		p.lock.Unlock()
+		a, b := upstreams[first], upstreams[second]
+		if atomic.LoadInt64(&b.active) < atomic.LoadInt64(&a.active) {
+			return b
+		}
+		return a
+	case BalanceConsistentHash:
+		if key := p.hashKey(req); key != "" {
+			hash := hashString(key)
+			i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+			// Walk the ring past targets out of rotation or already
+			// tried, so only their keys move.
+			for n := 0; n < len(p.ring); n++ {
+				if u := p.ring[(i+n)%len(p.ring)].upstream; hasUpstream(upstreams, u) {
+					return u
+				}
+			}
+		}
+	}
+	return p.roundRobin(upstreams)
+}
+
+func (u *Upstream) begin() {
+	atomic.AddInt64(&u.active, 1)
+	atomic.AddUint64(&u.requests, 1)
+}
+
+func (u *Upstream) end(failed bool) {
+	atomic.AddInt64(&u.active, -1)
+	if failed {
+		atomic.AddUint64(&u.failures, 1)
+	}
+}
+
+func (p *UpstreamPool) stats() []UpstreamStats {
+	stats := make([]UpstreamStats, 0, len(p.upstreams))
+	now := time.Now().UnixNano()
+	for _, u := range p.upstreams {
+		stats = append(stats, UpstreamStats{Target: u.URL.String(), Weight: u.Weight,
+			Healthy:        atomic.LoadInt32(&u.unhealthy) == 0,
+			Ejected:        atomic.LoadInt64(&u.ejectedUntil) >= now,
+			Ejections:      atomic.LoadUint64(&u.ejections),
+			LastCheckError: u.checkError(),
+			Active:         atomic.LoadInt64(&u.active),
+			Requests:       atomic.LoadUint64(&u.requests),
+			Failures:       atomic.LoadUint64(&u.failures)})
+	}
+	return stats
+}
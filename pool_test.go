@@ -0,0 +1,130 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func picks(t *testing.T, p *UpstreamPool, req *http.Request, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[p.pick(req).URL.Host]++
+	}
+	return counts
+}
+
+func TestUpstreamPoolBalancers(t *testing.T) {
+	targets := []PoolTarget{{URL: "http://a"}, {URL: "http://b", Weight: 3}, {URL: "http://c"}}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	p, _ := newUpstreamPool(targets, BalanceRoundRobin, "")
+	if counts := picks(t, p, req, 6); counts["a"] != 2 || counts["b"] != 2 || counts["c"] != 2 {
+		t.Errorf("round-robin: %v", counts)
+	}
+
+	p, _ = newUpstreamPool(targets, BalanceWeightedRoundRobin, "")
+	if counts := picks(t, p, req, 10); counts["a"] != 2 || counts["b"] != 6 || counts["c"] != 2 {
+		t.Errorf("weighted round-robin: %v", counts)
+	}
+
+	p, _ = newUpstreamPool(targets, BalanceLeastConnections, "")
+	p.upstreams[0].begin()
+	p.upstreams[1].begin()
+	if counts := picks(t, p, req, 5); counts["c"] != 5 {
+		t.Errorf("least connections: %v", counts)
+	}
+
+	p, _ = newUpstreamPool(targets[:2], BalanceRandomTwoChoices, "")
+	p.upstreams[0].begin()
+	if counts := picks(t, p, req, 5); counts["b"] != 5 {
+		t.Errorf("random two choices: %v", counts)
+	}
+
+	p, _ = newUpstreamPool(targets, BalanceConsistentHash, "Header:X-User")
+	seen := make(map[string]bool)
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", user)
+		counts := picks(t, p, req, 5)
+		if len(counts) != 1 {
+			t.Errorf("consistent hash spread %s over %v", user, counts)
+		}
+		for host := range counts {
+			seen[host] = true
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("consistent hash sent every user to %v", seen)
+	}
+	if counts := picks(t, p, req, 3); len(counts) != 3 {
+		t.Errorf("requests without the header should fall back to round-robin: %v", counts)
+	}
+
+	for _, c := range []struct{ balancer, hashOn string }{
+		{"Fastest", ""},
+		{BalanceConsistentHash, ""},
+		{BalanceConsistentHash, "Query:user"},
+	} {
+		if _, err := newUpstreamPool(targets, c.balancer, c.hashOn); err == nil {
+			t.Errorf("expected an error for %s %s", c.balancer, c.hashOn)
+		}
+	}
+}
+
+func TestUpstreamPoolRoute(t *testing.T) {
+	upstreams := make([]*httptest.Server, 2)
+	for i := range upstreams {
+		name := string(rune('a' + i))
+		upstreams[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer upstreams[i].Close()
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	body := `{"Name": "api", "Route": "/pool", "Balancer": "RoundRobin", "Targets": [{"URL": "` + upstreams[0].URL + `"}, {"URL": "` + upstreams[1].URL + `"}, {"URL": "` + down.URL + `"}]}`
+	if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+		t.Fatalf("create pool route: %d %s", resp.Code, resp.Body)
+	}
+	if resp := callAPI(t, api, "POST", "/proxy/route", `{"Name": "api", "Route": "/both", "Target": "`+down.URL+`", "Targets": [{"URL": "`+down.URL+`"}]}`); resp.Code != 422 {
+		t.Errorf("Target and Targets together: expected 422, got %d", resp.Code)
+	}
+
+	statuses := make(map[int]int)
+	for i := 0; i < 6; i++ {
+		r, err := http.Get("http://localhost:" + created.Port + "/pool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		statuses[r.StatusCode]++
+	}
+	if statuses[http.StatusOK] != 4 || statuses[http.StatusBadGateway] != 2 {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+
+	listed := ProxyMapResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy/route", `{"Name": "api"}`).Body.Bytes(), &listed)
+	if len(listed.Routes) != 1 || len(listed.Routes[0].Upstreams) != 3 {
+		t.Fatalf("unexpected routes %+v", listed.Routes)
+	}
+	for i, stats := range listed.Routes[0].Upstreams {
+		failures := uint64(0)
+		if i == 2 {
+			failures = 2
+		}
+		if stats.Requests != 2 || stats.Failures != failures || stats.Active != 0 {
+			t.Errorf("unexpected stats for %s: %+v", stats.Target, stats)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package minihyperproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ProxyPorts  = "Proxy"
+	HopperPorts = "Hopper"
+)
+
+type PortRange struct {
+	First int `json:"First"`
+	Last  int `json:"Last"`
+}
+
+func ParsePortRange(value string) (portRange PortRange, err error) {
+	bounds := strings.SplitN(value, "-", 2)
+	if portRange.First, err = strconv.Atoi(strings.TrimSpace(bounds[0])); err != nil {
+		return
+	}
+	portRange.Last = portRange.First
+	if len(bounds) == 2 {
+		if portRange.Last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return
+		}
+	}
+	if portRange.First < 1 || portRange.Last > 65535 || portRange.First > portRange.Last {
+		err = fmt.Errorf("invalid port range %q", value)
+	}
+	return
+}
+
+// PortAllocator hands out ports from a range per server type. A port is only
+// handed out if no server holds it and the OS lets us bind it; ports come
+// back to the pool when released.
+type PortAllocator struct {
+	Ranges   map[string]PortRange
+	reserved map[string]bool
+	probe    func(address string) bool
+	lock     sync.Mutex
+}
+
+func probePort(address string) bool {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// rangeFromEnv reads a "first-last" range from rangeEnv, falling back to a
+// range from the lowest single port in legacyEnvs to a hundred ports past the
+// highest one.
+func rangeFromEnv(rangeEnv string, fallback PortRange, legacyEnvs ...string) PortRange {
+	if value := getEnv(rangeEnv, ""); value != "" {
+		if portRange, err := ParsePortRange(value); err == nil {
+			return portRange
+		}
+	}
+	legacy := PortRange{}
+	for _, env := range legacyEnvs {
+		port, err := strconv.Atoi(getEnv(env, ""))
+		if err != nil {
+			continue
+		}
+		if legacy.First == 0 || port < legacy.First {
+			legacy.First = port
+		}
+		if port+99 > legacy.Last {
+			legacy.Last = port + 99
+		}
+	}
+	if legacy.First == 0 {
+		return fallback
+	}
+	return legacy
+}
+
+func NewPortAllocator() *PortAllocator {
+	return &PortAllocator{
+		Ranges: map[string]PortRange{
+			HopperPorts: rangeFromEnv("HOPPER_SERVER_PORTS", PortRange{First: 7053, Last: 7099}, "HOPPER_SERVER_INCOMING", "HOPPER_SERVER_OUTGOING"),
+			ProxyPorts:  rangeFromEnv("PROXY_SERVER_PORTS", PortRange{First: 7100, Last: 7199}, "PROXY_SERVER"),
+		},
+		reserved: make(map[string]bool),
+		probe:    probePort,
+	}
+}
+
+// Allocate reserves count free ports on hostname from the range of
+// serverType.
+func (p *PortAllocator) Allocate(serverType string, hostname string, count int) (ports []string, httpErr *HttpError) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	portRange, ok := p.Ranges[serverType]
+	if !ok {
+		return nil, WrongServerTypeError
+	}
+	for port := portRange.First; port <= portRange.Last && len(ports) < count; port++ {
+		address := net.JoinHostPort(hostname, strconv.Itoa(port))
+		if p.reserved[address] || !p.probe(address) {
+			continue
+		}
+		p.reserved[address] = true
+		ports = append(ports, strconv.Itoa(port))
+	}
+	if len(ports) < count {
+		p.release(hostname, ports...)
+		return nil, NoFreePortError
+	}
+	return
+}
+
+// Reserve claims an explicitly requested port, which may lie outside the
+// configured ranges.
+func (p *PortAllocator) Reserve(hostname string, port string) *HttpError {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return InvalidPortError
+	}
+	address := net.JoinHostPort(hostname, port)
+	if p.reserved[address] {
+		return ServerHostnamePortTakenError
+	}
+	p.reserved[address] = true
+	return nil
+}
+
+func (p *PortAllocator) Release(hostname string, ports ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.release(hostname, ports...)
+}
+
+func (p *PortAllocator) release(hostname string, ports ...string) {
+	for _, port := range ports {
+		delete(p.reserved, net.JoinHostPort(hostname, port))
+	}
+}
+
+func (p *PortAllocator) IsReserved(hostname string, port string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.reserved[net.JoinHostPort(hostname, port)]
+}
+
+// acquire reserves the requested ports, allocating from the serverType range
+// those left empty. Nothing stays reserved if it fails.
+func (p *PortAllocator) acquire(serverType string, hostname string, requested ...string) (ports []string, httpErr *HttpError) {
+	ports = make([]string, len(requested))
+	for i, port := range requested {
+		if port == "" {
+			continue
+		}
+		if httpErr = p.Reserve(hostname, port); httpErr != nil {
+			p.Release(hostname, ports...)
+			return nil, httpErr
+		}
+		ports[i] = port
+	}
+	for i := range ports {
+		if ports[i] != "" {
+			continue
+		}
+		allocated, httpErr := p.Allocate(serverType, hostname, 1)
+		if httpErr != nil {
+			p.Release(hostname, ports...)
+			return nil, httpErr
+		}
+		ports[i] = allocated[0]
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package minihyperproxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestPortAllocator(t *testing.T) {
+	busy, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+	first, _ := strconv.Atoi(busyPort)
+
+	p := NewPortAllocator()
+	p.Ranges[ProxyPorts] = PortRange{First: first, Last: first + 2}
+
+	ports, httpErr := p.Allocate(ProxyPorts, "localhost", 1)
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	if ports[0] == busyPort {
+		t.Fatalf("allocated port %s which the OS reports busy", busyPort)
+	}
+	if _, httpErr := p.Allocate(ProxyPorts, "localhost", 2); httpErr != NoFreePortError {
+		t.Fatalf("expected the range to be exhausted, got %v", httpErr)
+	}
+
+	p.Release("localhost", ports...)
+	if again, _ := p.Allocate(ProxyPorts, "localhost", 1); len(again) != 1 || again[0] != ports[0] {
+		t.Errorf("released port %s was not reused, got %v", ports[0], again)
+	}
+
+	if httpErr := p.Reserve("localhost", ports[0]); httpErr != ServerHostnamePortTakenError {
+		t.Errorf("reserving a taken port: expected %v, got %v", ServerHostnamePortTakenError, httpErr)
+	}
+	if httpErr := p.Reserve("localhost", "70000"); httpErr != InvalidPortError {
+		t.Errorf("reserving an invalid port: expected %v, got %v", InvalidPortError, httpErr)
+	}
+	if httpErr := p.Reserve("127.0.0.1", ports[0]); httpErr != nil {
+		t.Errorf("ports are accounted per hostname: %v", httpErr)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	if r, err := ParsePortRange("7100-7199"); err != nil || r.First != 7100 || r.Last != 7199 {
+		t.Errorf("unexpected range %v %v", r, err)
+	}
+	if r, err := ParsePortRange("8080"); err != nil || r.First != 8080 || r.Last != 8080 {
+		t.Errorf("unexpected range %v %v", r, err)
+	}
+	for _, value := range []string{"7199-7100", "0-10", "a-b"} {
+		if _, err := ParsePortRange(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestRangeFromEnv(t *testing.T) {
+	os.Setenv("HOPPER_SERVER_INCOMING", "8000")
+	os.Setenv("HOPPER_SERVER_OUTGOING", "8001")
+	defer os.Unsetenv("HOPPER_SERVER_INCOMING")
+	defer os.Unsetenv("HOPPER_SERVER_OUTGOING")
+	if r := NewPortAllocator().Ranges[HopperPorts]; r.First != 8000 || r.Last != 8100 {
+		t.Errorf("legacy hopper ports: unexpected range %v", r)
+	}
+
+	os.Setenv("HOPPER_SERVER_PORTS", "9000-9010")
+	defer os.Unsetenv("HOPPER_SERVER_PORTS")
+	if r := NewPortAllocator().Ranges[HopperPorts]; r.First != 9000 || r.Last != 9010 {
+		t.Errorf("the range should win over legacy ports, got %v", r)
+	}
+}
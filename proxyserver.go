@@ -2,12 +2,17 @@ package minihyperproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -25,116 +30,380 @@ func singleJoiningSlash(a, b string) string {
 }
 
 type ProxyServer struct {
-	ServerName     string
-	Hostname       string
-	ServerPort     string
-	Status         string
-	httpServer     *http.Server
-	httpMux        *mux.Router
-	infoLog        *log.Logger
-	warnLog        *log.Logger
-	errorLog       *log.Logger
-	ProxyReference map[string]string
-	ProxyMap       map[string]func(w http.ResponseWriter, r *http.Request)
+	ServerName    string
+	Hostname      string
+	ServerPort    string
+	Status        string
+	httpServer    *http.Server
+	listener      net.Listener
+	httpMux       atomic.Value
+	lock          sync.RWMutex
+	lifecycleLock sync.Mutex
+	statusLock    sync.Mutex
+	lastError     error
+	infoLog       *log.Logger
+	warnLog       *log.Logger
+	errorLog      *log.Logger
+	options       ServerOptions
+	upstream      *upstreamSettings
+	transport     http.RoundTripper
+	tlsConfig     atomic.Value
+	tunnelIdle    time.Duration
+	Routes        map[string]*ProxyRoute
 }
 
 func NewProxyServer(serverName string, hostname string, port string) *ProxyServer {
 
 	s := &ProxyServer{ServerName: serverName,
-		Hostname:       hostname,
-		ServerPort:     port,
-		infoLog:        log.New(os.Stdout, serverName+"-INFO: ", log.Ldate|log.Ltime|log.Lshortfile),
-		warnLog:        log.New(os.Stdout, serverName+"-WARN: ", log.Ldate|log.Ltime|log.Lshortfile),
-		errorLog:       log.New(os.Stdout, serverName+"-ERROR: ", log.Ldate|log.Ltime|log.Lshortfile),
-		Status:         "Down",
-		ProxyMap:       make(map[string]func(w http.ResponseWriter, r *http.Request)),
-		ProxyReference: make(map[string]string)}
+		Hostname:   hostname,
+		ServerPort: port,
+		infoLog:    log.New(os.Stdout, serverName+"-INFO: ", log.Ldate|log.Ltime|log.Lshortfile),
+		warnLog:    log.New(os.Stdout, serverName+"-WARN: ", log.Ldate|log.Ltime|log.Lshortfile),
+		errorLog:   log.New(os.Stdout, serverName+"-ERROR: ", log.Ldate|log.Ltime|log.Lshortfile),
+		Status:     StatusDown,
+		transport:  http.DefaultTransport,
+		Routes:     make(map[string]*ProxyRoute)}
 	s.init()
 
 	return s
 }
 
 func (s *ProxyServer) init() {
-	s.httpMux = mux.NewRouter().StrictSlash(true)
-	s.httpServer = &http.Server{Addr: s.Hostname + ":" + s.ServerPort,
-		Handler: s.httpMux}
+	s.httpMux.Store(mux.NewRouter().StrictSlash(true))
+	s.initHTTPServer()
 }
 
-func (s *ProxyServer) Serve() {
+// initHTTPServer builds a fresh http.Server, since one that has been shut down
+// cannot serve again. Routes live in httpMux and survive the swap.
+func (s *ProxyServer) initHTTPServer() {
+	settings, _ := s.serverOptions().settings()
+	s.httpServer = &http.Server{Addr: s.Hostname + ":" + s.ServerPort,
+		Handler:           s,
+		ReadHeaderTimeout: settings.readHeaderTimeout,
+		ReadTimeout:       settings.readTimeout,
+		WriteTimeout:      settings.writeTimeout,
+		IdleTimeout:       settings.idleTimeout}
 	s.httpServer.RegisterOnShutdown(func() {
 		s.infoLog.Printf("Server: " + s.ServerName + " stopping")
 	})
+}
+
+// configure applies options, validated by the caller, to a server not
+// serving yet.
+func (s *ProxyServer) configure(options ServerOptions) {
+	s.lock.Lock()
+	s.options = options
+	s.upstream, s.transport = nil, http.DefaultTransport
+	if options.Upstream != nil {
+		s.upstream, _ = options.Upstream.settings()
+		s.transport = s.upstream.transport()
+	}
+	settings, _ := options.settings()
+	s.tunnelIdle = settings.tunnelIdleTimeout
+	var tlsConfig *tls.Config
+	if options.TLS != nil {
+		tlsConfig, _ = options.TLS.config()
+	}
+	s.tlsConfig.Store(tlsConfig)
+	s.lock.Unlock()
+	s.initHTTPServer()
+}
+
+func (s *ProxyServer) serverOptions() ServerOptions {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.options
+}
+
+// upstreamTransport is the transport of the hop proxy, shared by the routes
+// that do not override the Upstream settings of the server.
+func (s *ProxyServer) upstreamTransport() (http.RoundTripper, time.Duration) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.upstream == nil {
+		return s.transport, 0
+	}
+	return s.transport, s.upstream.requestTimeout
+}
+
+func (s *ProxyServer) setStatus(status string, err error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	s.Status = status
+	if err != nil {
+		s.lastError = err
+	}
+}
+
+func (s *ProxyServer) getStatus() (string, error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	return s.Status, s.lastError
+}
+
+func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.httpMux.Load().(*mux.Router).ServeHTTP(w, r)
+}
+
+// rebuildMux swaps in a fresh router built from Routes, since gorilla/mux
+// cannot unregister or replace a route once added. Routes are registered in
+// precedence order as the router picks the first match. Requests in flight
+// keep the router they started with. Callers hold s.lock.
+func (s *ProxyServer) rebuildMux() {
+	httpMux := mux.NewRouter().StrictSlash(true)
+	for _, route := range sortRoutes(s.Routes) {
+		route.register(httpMux)
+	}
+	s.httpMux.Store(httpMux)
+}
+
+// Serve binds the listener before returning, so a port already in use is
+// reported to the caller instead of only being logged.
+func (s *ProxyServer) Serve() error {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	if status, _ := s.getStatus(); status == StatusUp || status == StatusStarting {
+		s.warnLog.Printf("Trying to start server: %s which is already %s", s.ServerName, status)
+		return nil
+	}
+	s.setStatus(StatusStarting, nil)
+	s.initHTTPServer()
+	httpServer := s.httpServer
 	s.infoLog.Printf("Server: " + s.ServerName + " starting")
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		s.errorLog.Printf(err.Error())
+		s.setStatus(StatusFailed, err)
+		return err
+	}
+	if s.currentTLSConfig() != nil {
+		// Each handshake picks up the current config, so swapped
+		// certificates apply without restarting the listener.
+		listener = tls.NewListener(listener, &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.currentTLSConfig(), nil
+		}})
+	}
+	s.listener = listener
+	// Up before serving, so that a failure of the listener is not overwritten.
+	s.setStatus(StatusUp, nil)
 	go func() {
-		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		if err := httpServer.Serve(listener); err != http.ErrServerClosed {
 			s.errorLog.Printf(err.Error())
+			s.setStatus(StatusFailed, err)
 		}
 	}()
 	s.infoLog.Printf("Listening on: " + s.ServerPort)
-	s.Status = "Up"
+	s.startHealthChecks()
+	return nil
 }
 
 func (s *ProxyServer) Stop() {
-	if s.Status == "Down" {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	if status, _ := s.getStatus(); status == StatusDown {
 		s.warnLog.Printf("Trying to stop server: %s which is already stopped", s.ServerName)
-	} else if err := s.httpServer.Shutdown(context.Background()); err != nil {
+		return
+	}
+	s.setStatus(StatusDraining, nil)
+	s.stopHealthChecks()
+	err := s.httpServer.Shutdown(context.Background())
+	// Shutdown only closes listeners Serve already picked up, which the
+	// goroutine started by a very recent Serve call may not have done yet.
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if err != nil {
 		s.errorLog.Printf(err.Error())
+		s.setStatus(StatusFailed, err)
+	} else {
+		s.setStatus(StatusDown, nil)
 	}
 }
+
 func (s *ProxyServer) StartIncomingHopProxy(director func(*http.Request), serveFunc func(*httputil.ReverseProxy, http.ResponseWriter, *http.Request)) {
-	rProxy := &httputil.ReverseProxy{Director: director}
-	s.ProxyMap["/"] = func(w http.ResponseWriter, r *http.Request) {
-		serveFunc(rProxy, w, r)
-	}
-	s.ProxyReference["/"] = "incoming_hop_server"
-	s.httpMux.PathPrefix("/").HandlerFunc(s.ProxyMap["/"])
+	s.startHopProxy(director, serveFunc)
 }
 func (s *ProxyServer) StartOutgoingHopProxy(director func(*http.Request), serveFunc func(*httputil.ReverseProxy, http.ResponseWriter, *http.Request)) {
-	rProxy := &httputil.ReverseProxy{Director: director}
-	s.ProxyMap["/"] = func(w http.ResponseWriter, r *http.Request) {
-		serveFunc(rProxy, w, r)
-	}
-	s.ProxyReference["/"] = "incoming_hop_server"
-	s.httpMux.PathPrefix("/").HandlerFunc(s.ProxyMap["/"])
+	s.startHopProxy(director, serveFunc)
 }
 
-func (s *ProxyServer) NewProxy(route *url.URL, target *url.URL) {
+func (s *ProxyServer) startHopProxy(director func(*http.Request), serveFunc func(*httputil.ReverseProxy, http.ResponseWriter, *http.Request)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rProxy := &httputil.ReverseProxy{Director: director,
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if transport, ok := req.Context().Value(hopTransportKey{}).(http.RoundTripper); ok {
+				return transport.RoundTrip(req)
+			}
+			transport, _ := s.upstreamTransport()
+			return transport.RoundTrip(req)
+		})}
+	s.Routes["/"] = &ProxyRoute{Route: "/", Options: RouteOptions{Match: MatchPrefix},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			if isUpgrade(r) {
+				w = s.tunnel(w)
+			} else if _, timeout := s.upstreamTransport(); timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			serveFunc(rProxy, w, r)
+		}}
+	s.rebuildMux()
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
 
-	s.infoLog.Printf("Creating new proxy from %v to %v", route.EscapedPath(), target)
+type proxyAttemptKey struct{}
 
+// proxyAttempt follows a request to the upstream it was sent to. in is the
+// request as received and body its buffered body, if any.
+type proxyAttempt struct {
+	upstream   *Upstream
+	failed     bool
+	in         *http.Request
+	body       []byte
+	replayable bool
+}
+
+// direct points req to the upstream of attempt.
+func (r *ProxyRoute) direct(req *http.Request, attempt *proxyAttempt) {
+	target := attempt.upstream.URL
 	targetQuery := target.RawQuery
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path = r.targetPath(attempt.in, target)
+	req.URL.RawPath = ""
+	req.Host = target.Host
+	if targetQuery == "" || attempt.in.URL.RawQuery == "" {
+		req.URL.RawQuery = targetQuery + attempt.in.URL.RawQuery
+	} else {
+		req.URL.RawQuery = targetQuery + "&" + attempt.in.URL.RawQuery
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+// NewProxy adds a route forwarding to target, or to the pool of
+// options.Targets when target is nil.
+func (s *ProxyServer) NewProxy(route string, target *url.URL, options RouteOptions) error {
+	proxyRoute, err := newProxyRoute(route, target, options)
+	if err != nil {
+		return err
+	}
+
+	if target != nil {
+		s.infoLog.Printf("Creating new %s proxy from %v to %v", proxyRoute.kind(), route, target)
+	} else {
+		s.infoLog.Printf("Creating new %s proxy from %v to %d targets balanced by %s", proxyRoute.kind(), route, len(options.Targets), proxyRoute.pool.Balancer)
+	}
+
 	director := func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.URL.Path = target.Path
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+		proxyRoute.direct(req, req.Context().Value(proxyAttemptKey{}).(*proxyAttempt))
+	}
+
+	rProxy := &httputil.ReverseProxy{Director: director,
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode >= http.StatusInternalServerError {
+				resp.Request.Context().Value(proxyAttemptKey{}).(*proxyAttempt).failed = true
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			r.Context().Value(proxyAttemptKey{}).(*proxyAttempt).failed = true
+			s.errorLog.Printf("Proxying to %v failed: %v", r.URL.Host, err)
+			if errorClass(err) == RetryTimeout {
+				w.WriteHeader(http.StatusGatewayTimeout)
+			} else {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}}
+	transport, requestTimeout := s.upstreamTransport()
+	if options.Upstream != nil {
+		upstream, _ := mergeUpstreamOptions(s.serverOptions().Upstream, options.Upstream).settings()
+		proxyRoute.transport = upstream.transport()
+		transport, requestTimeout = proxyRoute.transport, upstream.requestTimeout
+	}
+	if merged := mergeUpstreamOptions(s.serverOptions().Upstream, options.Upstream); merged != nil && merged.TLS != nil && merged.TLS.InsecureSkipVerify {
+		s.warnLog.Printf("Route %v skips the verification of upstream certificates", proxyRoute.key())
+	}
+	proxyRoute.pool.transport = transport
+	rProxy.Transport = transport
+	if proxyRoute.retry != nil {
+		rProxy.Transport = &retryTransport{server: s, route: proxyRoute, transport: transport}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	proxyRoute.handler = func(w http.ResponseWriter, r *http.Request) {
+		if proxyRoute.breaker != nil && !proxyRoute.breaker.allow(w) {
+			s.warnLog.Printf("Circuit breaker open for %v", proxyRoute.key())
+			return
+		}
+		if isUpgrade(r) {
+			w = s.tunnel(w)
+		} else if requestTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
 		}
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
+		start := time.Now()
+		attempt := &proxyAttempt{upstream: proxyRoute.pool.pick(r)}
+		if attempt.upstream == nil {
+			s.warnLog.Printf("No healthy upstream for %v", proxyRoute.key())
+			http.Error(w, "503 - No healthy upstream", http.StatusServiceUnavailable)
+			if proxyRoute.breaker != nil {
+				proxyRoute.breaker.record(true, time.Since(start))
+			}
+			return
 		}
+		s.infoLog.Printf("Proxying request to %v", attempt.upstream.URL.Host+attempt.upstream.URL.EscapedPath())
+		attempt.upstream.begin()
+		defer func() {
+			attempt.upstream.end(attempt.failed)
+			proxyRoute.pool.observe(attempt.upstream, attempt.failed)
+			if proxyRoute.breaker != nil {
+				proxyRoute.breaker.record(attempt.failed, time.Since(start))
+			}
+		}()
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		if proxyRoute.retry != nil {
+			proxyRoute.retry.deposit()
+			attempt.body, attempt.replayable = proxyRoute.retry.buffer(r)
+		}
+		attempt.in = r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, attempt))
+		rProxy.ServeHTTP(w, attempt.in)
 	}
-
-	rProxy := &httputil.ReverseProxy{Director: director}
-	s.ProxyMap[route.EscapedPath()] = func(w http.ResponseWriter, r *http.Request) {
-		s.infoLog.Printf("Proxying request to %v", target.Host+target.EscapedPath())
-		r.URL.Host = target.Host
-		r.URL.Scheme = target.Scheme
-		r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-		r.Host = target.Host
-		rProxy.ServeHTTP(w, r)
+	if old, ok := s.Routes[proxyRoute.key()]; ok {
+		old.close()
 	}
-	s.ProxyReference[route.EscapedPath()] = target.Host + target.EscapedPath()
-	s.httpMux.HandleFunc(route.EscapedPath(), s.ProxyMap[route.EscapedPath()])
+	s.Routes[proxyRoute.key()] = proxyRoute
+	s.rebuildMux()
+	if status, _ := s.getStatus(); status == StatusUp {
+		proxyRoute.pool.startChecks()
+	}
+	return nil
 }
 
-func (s *ProxyServer) DeleteProxy(route *url.URL) {
-	s.infoLog.Printf("Deleting proxy for: %v", route)
-	delete(s.ProxyReference, route.EscapedPath())
-	delete(s.ProxyMap, route.EscapedPath())
+// DeleteProxy reports whether there was a proxy for the route with key to
+// delete.
+func (s *ProxyServer) DeleteProxy(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	route, ok := s.Routes[key]
+	if !ok {
+		return false
+	}
+	route.close()
+	s.infoLog.Printf("Deleting proxy for: %v", key)
+	delete(s.Routes, key)
+	s.rebuildMux()
+	return true
 }
 
 func (s *ProxyServer) Type() string {
@@ -146,10 +415,40 @@ func (s *ProxyServer) Info() *map[string]interface{} {
 	ret["Name"] = s.ServerName
 	ret["Port"] = s.ServerPort
 	ret["Type"] = s.Type()
-	ret["Status"] = s.Status
+	status, lastError := s.getStatus()
+	ret["Status"] = status
+	if lastError != nil {
+		ret["LastError"] = lastError.Error()
+	}
+	if options := s.serverOptions(); options != (ServerOptions{}) {
+		ret["Options"] = options.redacted()
+	}
+	if tlsConfig := s.currentTLSConfig(); tlsConfig != nil {
+		ret["Certificates"] = certificatesInfo(tlsConfig)
+	}
+	if health := s.getHealth(); len(health) > 0 {
+		ret["Health"] = health
+	}
 	return &ret
 }
 
 func (s *ProxyServer) getProxyMap() map[string]string {
-	return s.ProxyReference
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	proxyMap := make(map[string]string, len(s.Routes))
+	for key, r := range s.Routes {
+		proxyMap[key] = r.info(0).Target
+	}
+	return proxyMap
+}
+
+// getRoutes lists the routes in the order they are matched in.
+func (s *ProxyServer) getRoutes() []RouteInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	routes := make([]RouteInfo, 0, len(s.Routes))
+	for i, r := range sortRoutes(s.Routes) {
+		routes = append(routes, r.info(i+1))
+	}
+	return routes
 }
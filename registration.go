@@ -0,0 +1,276 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// controlPath is where incoming hop proxies answer the registrations of
+// the hoppers hopping to them.
+const controlPath = "/.mhp/hops"
+
+const (
+	defaultRegistrationInterval = 30 * time.Second
+	registrationTimeout         = 5 * time.Second
+)
+
+// RegistrationAck is the answer of a hopper to a registration.
+type RegistrationAck struct {
+	Hopper string `json:"Hopper"`
+	Target string `json:"Target"`
+	Lease  string `json:"Lease,omitempty"`
+}
+
+// registrationError is a failure to register a hop on its remote hoppers.
+type registrationError struct {
+	error
+}
+
+// registration is an incoming hop registered by peers, each until its lease
+// runs out. owned tells whether it was created by the registrations, and so
+// goes away with them.
+type registration struct {
+	leases map[string]time.Time
+	owned  bool
+}
+
+func (h *HopperServer) registrationInterval() time.Duration {
+	interval, _ := parseDuration("RegistrationInterval", h.OutgoingHopProxy.serverOptions().RegistrationInterval, defaultRegistrationInterval)
+	return interval
+}
+
+// hopRoute lists the hoppers a hop goes through, in order.
+func hopRoute(hop *url.URL, via []string) []*url.URL {
+	hops, _ := parseHopRoute(strings.Join(via, ","))
+	return append([]*url.URL{hop}, hops...)
+}
+
+// register registers, or unregisters with DELETE, the incoming hop to target
+// on the hopper at hop, which must acknowledge it.
+func (h *HopperServer) register(method string, target *url.URL, hop *url.URL) error {
+	req, err := http.NewRequest(method, hop.Scheme+"://"+hop.Host+controlPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-MHP-Target-Host", target.Host)
+	req.Header.Set("X-MHP-Target-Scheme", target.Scheme)
+	req.Header.Set("X-MHP-Hop-Ids", h.identity)
+	req.Header.Set("X-MHP-Hop-Lease", (3 * h.registrationInterval()).String())
+	if signer := h.getSigner(); signer != nil {
+		signer.sign(req)
+	}
+	transport, _ := h.OutgoingHopProxy.upstreamTransport()
+	resp, err := (&http.Client{Transport: transport, Timeout: registrationTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ack := RegistrationAck{}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&ack) != nil || ack.Target != target.Host {
+		return fmt.Errorf("%s did not acknowledge the hop to %s: %s", hop.Host, target.Host, resp.Status)
+	}
+	return nil
+}
+
+// registerRoute registers the hop to target on every hopper of its route,
+// undoing the registrations already made if one fails.
+func (h *HopperServer) registerRoute(target *url.URL, hop *url.URL, via []string) error {
+	route := hopRoute(hop, via)
+	for i, remote := range route {
+		if err := h.register(http.MethodPost, target, remote); err != nil {
+			for _, registered := range route[:i] {
+				if err := h.register(http.MethodDelete, target, registered); err != nil {
+					h.warnLog.Printf("Could not roll back the registration of %v on %v: %v", target, registered, err)
+				}
+			}
+			return &registrationError{err}
+		}
+	}
+	h.infoLog.Printf("Registered hop to %v on %d hoppers", target, len(route))
+	return nil
+}
+
+func (h *HopperServer) unregisterRoute(target *url.URL, hop *url.URL, via []string) {
+	for _, remote := range hopRoute(hop, via) {
+		if err := h.register(http.MethodDelete, target, remote); err != nil {
+			h.warnLog.Printf("Could not unregister the hop to %v from %v: %v", target, remote, err)
+		}
+	}
+}
+
+// controlAllowed tells whether registrations can be authenticated, by their
+// signature or the certificate of the peer.
+func (h *HopperServer) controlAllowed() bool {
+	signer := h.getSigner()
+	return (signer != nil && signer.verifies()) || h.OutgoingHopProxy.serverOptions().PeerTLS != nil
+}
+
+func (h *HopperServer) serveControl(resp http.ResponseWriter, req *http.Request) {
+	if !h.controlAllowed() {
+		resp.WriteHeader(http.StatusForbidden)
+		resp.Write([]byte("403 - Registrations need HopSigning or PeerTLS"))
+		return
+	}
+	target := &url.URL{Scheme: req.Header.Get("X-MHP-Target-Scheme"), Host: req.Header.Get("X-MHP-Target-Host")}
+	if target.Scheme == "" {
+		target.Scheme = "http"
+	}
+	peer := req.Header.Get("X-MHP-Hop-Ids")
+	lease, err := time.ParseDuration(req.Header.Get("X-MHP-Hop-Lease"))
+	if target.Host == "" || peer == "" || (req.Method == http.MethodPost && (err != nil || lease <= 0)) {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte("400 - Invalid registration"))
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+		h.registerIncomingHop(target, peer, lease)
+	case http.MethodDelete:
+		h.unregisterIncomingHop(target, peer)
+		lease = 0
+	default:
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ack := RegistrationAck{Hopper: h.ServerName, Target: target.Host}
+	if lease > 0 {
+		ack.Lease = lease.String()
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(ack)
+}
+
+func (h *HopperServer) registerIncomingHop(target *url.URL, peer string, lease time.Duration) {
+	host := target.Hostname()
+	h.lock.Lock()
+	reg, ok := h.registrations[host]
+	if !ok {
+		_, exists := h.IncomingHopsReference[host]
+		reg = &registration{leases: make(map[string]time.Time), owned: !exists}
+		h.registrations[host] = reg
+	}
+	reg.leases[peer] = time.Now().Add(lease)
+	owned := reg.owned
+	h.lock.Unlock()
+	if owned {
+		h.putIncomingHop(target)
+	}
+}
+
+func (h *HopperServer) unregisterIncomingHop(target *url.URL, peer string) {
+	host := target.Hostname()
+	h.lock.Lock()
+	reg, ok := h.registrations[host]
+	if ok {
+		delete(reg.leases, peer)
+	}
+	h.lock.Unlock()
+	if ok {
+		h.dropRegistrations(host, time.Now())
+	}
+}
+
+// dropRegistrations forgets the leases on host run out by now, along with
+// the incoming hop if it has no more lease and was created by them.
+func (h *HopperServer) dropRegistrations(host string, now time.Time) {
+	h.lock.Lock()
+	reg, ok := h.registrations[host]
+	if !ok {
+		h.lock.Unlock()
+		return
+	}
+	for peer, expiry := range reg.leases {
+		if now.After(expiry) {
+			delete(reg.leases, peer)
+		}
+	}
+	drop := len(reg.leases) == 0
+	if drop {
+		delete(h.registrations, host)
+	}
+	h.lock.Unlock()
+	if drop && reg.owned {
+		h.infoLog.Printf("Registrations of the incoming hop for %v ran out", host)
+		h.deleteIncomingHop(&url.URL{Host: host})
+	}
+}
+
+// registeredHop is an outgoing hop registered on the hoppers of its route.
+type registeredHop struct {
+	target *url.URL
+	hop    *url.URL
+	via    []string
+}
+
+func (h *HopperServer) registeredHops() map[string]registeredHop {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	hops := make(map[string]registeredHop)
+	for host, options := range h.outgoingHopOptions {
+		if options.Register {
+			target, hop := *h.outgoingTargets[host], *h.OutgoingHopsReference[host]
+			hops[host] = registeredHop{target: &target, hop: &hop, via: options.Via}
+		}
+	}
+	return hops
+}
+
+// reconcile renews the registrations of the outgoing hops of h, which
+// restores them on remote hoppers that restarted, and lets the leases of
+// peers that stopped renewing theirs run out. Hops removed while being
+// renewed are unregistered again, as their removal may have come first.
+func (h *HopperServer) reconcile() {
+	for host, r := range h.registeredHops() {
+		if err := h.registerRoute(r.target, r.hop, r.via); err != nil {
+			h.warnLog.Printf("Could not renew the registration of the hop to %v: %v", host, err)
+		} else if current, ok := h.registeredHops()[host]; !ok || current.hop.String() != r.hop.String() {
+			h.unregisterRoute(r.target, r.hop, r.via)
+		}
+	}
+	h.lock.RLock()
+	hosts := make([]string, 0, len(h.registrations))
+	for host := range h.registrations {
+		hosts = append(hosts, host)
+	}
+	h.lock.RUnlock()
+	now := time.Now()
+	for _, host := range hosts {
+		h.dropRegistrations(host, now)
+	}
+}
+
+func (h *HopperServer) startReconciling() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.stopReconciling != nil {
+		return
+	}
+	done := make(chan struct{})
+	h.stopReconciling = func() { close(done) }
+	interval := h.registrationInterval()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				h.reconcile()
+			}
+		}
+	}()
+}
+
+func (h *HopperServer) stopReconcile() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.stopReconciling != nil {
+		h.stopReconciling()
+		h.stopReconciling = nil
+	}
+}
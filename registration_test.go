@@ -0,0 +1,137 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHopRegistration(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	m := NewMinihyperProxy()
+	ports := make(map[string][]string)
+	hoppers := make(map[string]*HopperServer)
+	for name, signing := range map[string]*HopSigning{
+		"a":      {SharedKey: "s3cret"},
+		"b":      {SharedKey: "s3cret"},
+		"other":  {SharedKey: "0ther"},
+		"open":   nil,
+		"second": {SharedKey: "s3cret"},
+	} {
+		incomingPort, outgoingPort, _, httpErr := m.startHopperServer(name, "", "", "", ServerOptions{HopSigning: signing, RegistrationInterval: "50ms"})
+		if httpErr != nil {
+			t.Fatalf("start %s: %v", name, httpErr)
+		}
+		defer m.removeServer(name)
+		ports[name] = []string{incomingPort, outgoingPort}
+		s, _ := m.server(name)
+		hoppers[name] = (*s).(*HopperServer)
+	}
+	hopURL := func(name string) *url.URL { return &url.URL{Scheme: "http", Host: "localhost:" + ports[name][0]} }
+	registered := func(name string) bool {
+		_, ok := hoppers[name].getIncomingHops()[upstreamURL.Hostname()]
+		return ok
+	}
+	register := HopOptions{Register: true}
+
+	if httpErr := m.AddHop("a", upstreamURL, hopURL("b"), register); httpErr != nil {
+		t.Fatalf("register: %v", httpErr)
+	}
+	if !registered("b") {
+		t.Fatalf("b did not receive the registered hop")
+	}
+	if status, _ := getBody(t, "http://localhost:"+ports["a"][1]+"/"+upstreamURL.Hostname()+"/"); status != http.StatusOK {
+		t.Errorf("registered hop: expected 200, got %d", status)
+	}
+	if hops := hoppers["a"].exportConfig().OutgoingHops; hops[0].Target != upstream.URL {
+		t.Errorf("export lost the target port: %+v", hops)
+	}
+
+	// b forgetting the hop, as after a restart, gets it back from a.
+	hoppers["b"].deleteIncomingHop(upstreamURL)
+	waitFor(t, "the hop to be registered again", func() bool { return registered("b") })
+
+	if httpErr := m.RemoveHop("a", upstreamURL); httpErr != nil || registered("b") {
+		t.Errorf("removing the hop should unregister it, got %v", httpErr)
+	}
+
+	// A hop registered along with a manual one leaves it in place.
+	m.ReceiveHop("b", upstreamURL, upstreamURL)
+	m.AddHop("a", upstreamURL, hopURL("b"), register)
+	m.RemoveHop("a", upstreamURL)
+	if !registered("b") {
+		t.Errorf("unregistering removed the manual incoming hop")
+	}
+	hoppers["b"].deleteIncomingHop(upstreamURL)
+
+	for name, hop := range map[string]*url.URL{
+		"unsigned hopper":    hopURL("open"),
+		"unreachable hopper": {Scheme: "http", Host: "localhost:1"},
+		"plain server":       {Scheme: "http", Host: upstreamURL.Host},
+	} {
+		httpErr := m.AddHop("a", upstreamURL, hop, register)
+		if httpErr == nil || httpErr.code != http.StatusBadGateway {
+			t.Errorf("%s: expected a 502 registration error, got %v", name, httpErr)
+		}
+		if _, ok := hoppers["a"].getOutgoingHops()[upstreamURL.Hostname()]; ok {
+			t.Errorf("%s: failed registration left an outgoing hop", name)
+		}
+	}
+
+	// other rejects the signature of a, so the registration on b is undone.
+	via := HopOptions{Register: true, Via: []string{hopURL("other").String()}}
+	if httpErr := m.AddHop("a", upstreamURL, hopURL("b"), via); httpErr == nil || registered("b") {
+		t.Errorf("expected the registration on b to be rolled back, got %v", httpErr)
+	}
+
+	// Leases run out once their hopper stops renewing them.
+	m.AddHop("second", upstreamURL, hopURL("b"), register)
+	if !registered("b") {
+		t.Fatalf("b did not receive the registered hop")
+	}
+	m.stopServer("second")
+	waitFor(t, "the lease to run out", func() bool { return !registered("b") })
+
+	// A peer slow to renew does not hold hops added meanwhile up.
+	var calls int32
+	release, blocked := make(chan struct{}), make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+			<-release
+		}
+		json.NewEncoder(w).Encode(RegistrationAck{Target: r.Header.Get("X-MHP-Target-Host")})
+	}))
+	defer slow.Close()
+	defer close(release)
+	slowURL, _ := url.Parse(slow.URL)
+	if httpErr := m.AddHop("a", &url.URL{Scheme: "http", Host: "slow.example.com"}, slowURL, register); httpErr != nil {
+		t.Fatalf("register on the slow peer: %v", httpErr)
+	}
+	<-blocked
+	start := time.Now()
+	if httpErr := m.AddHop("a", upstreamURL, hopURL("b"), register); httpErr != nil || time.Since(start) > time.Second {
+		t.Errorf("registration held up by a renewal: %v after %v", httpErr, time.Since(start))
+	}
+
+	resp, err := http.Post(hopURL("open").String()+controlPath, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unauthenticated registration: expected 403, got %d", resp.StatusCode)
+	}
+}
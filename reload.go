@@ -0,0 +1,418 @@
+package minihyperproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+const (
+	ActionAddServer         = "AddServer"
+	ActionRemoveServer      = "RemoveServer"
+	ActionAddRoute          = "AddRoute"
+	ActionRemoveRoute       = "RemoveRoute"
+	ActionAddOutgoingHop    = "AddOutgoingHop"
+	ActionRemoveOutgoingHop = "RemoveOutgoingHop"
+	ActionAddIncomingHop    = "AddIncomingHop"
+	ActionRemoveIncomingHop = "RemoveIncomingHop"
+)
+
+// ConfigChange is a single step needed to move the running servers to a new
+// config, along with what undoes it.
+type ConfigChange struct {
+	Action string `json:"Action"`
+	Server string `json:"Server"`
+	Key    string `json:"Key,omitempty"`
+	Value  string `json:"Value,omitempty"`
+	apply  func() *HttpError
+	revert func() *HttpError
+}
+
+type ConfigDiff struct {
+	File       string         `json:"File"`
+	Time       time.Time      `json:"Time"`
+	Changes    []ConfigChange `json:"Changes"`
+	Applied    bool           `json:"Applied"`
+	RolledBack bool           `json:"RolledBack"`
+	Error      string         `json:"Error,omitempty"`
+}
+
+func (c ConfigChange) String() string {
+	s := c.Action + " " + c.Server
+	if c.Key != "" {
+		s += " " + c.Key
+	}
+	if c.Value != "" {
+		s += " -> " + c.Value
+	}
+	return s
+}
+
+func normalizeHopURL(rawURL string) string {
+	parsed, _ := url.Parse(rawURL)
+	reduced, _ := reduceTargetHop(parsed, parsed)
+	return exportURL(reduced)
+}
+
+func normalizeURL(rawURL string) string {
+	parsed, _ := url.Parse(rawURL)
+	return parsed.String()
+}
+
+func hostnameOf(rawURL string) string {
+	parsed, _ := url.Parse(rawURL)
+	return parsed.Hostname()
+}
+
+func singleServerConfig(proxy *ProxyConfig, hopper *HopperConfig) (string, *Config) {
+	if proxy != nil {
+		return proxy.Name, &Config{Proxies: []ProxyConfig{*proxy}}
+	}
+	return hopper.Name, &Config{Hoppers: []HopperConfig{*hopper}}
+}
+
+func (m *MinihyperProxy) addServerChanges(diff *ConfigDiff, proxy *ProxyConfig, hopper *HopperConfig) {
+	name, single := singleServerConfig(proxy, hopper)
+	diff.Changes = append(diff.Changes, ConfigChange{Action: ActionAddServer, Server: name,
+		apply: func() *HttpError {
+			if err := m.importConfig(diff.File, single); err != nil {
+				return &HttpError{ErrString: err.Error(), code: 500}
+			}
+			return nil
+		},
+		revert: func() *HttpError { return m.removeServer(name) }})
+}
+
+func (m *MinihyperProxy) removeServerChanges(diff *ConfigDiff, proxy *ProxyConfig, hopper *HopperConfig) {
+	name, single := singleServerConfig(proxy, hopper)
+	diff.Changes = append(diff.Changes, ConfigChange{Action: ActionRemoveServer, Server: name,
+		apply: func() *HttpError { return m.removeServer(name) },
+		revert: func() *HttpError {
+			if err := m.importConfig(diff.File, single); err != nil {
+				return &HttpError{ErrString: err.Error(), code: 500}
+			}
+			return nil
+		}})
+}
+
+func sameRoute(a, b RouteConfig) bool {
+	return normalizeURL(a.Target) == normalizeURL(b.Target) && reflect.DeepEqual(a.RouteOptions, b.RouteOptions)
+}
+
+func (m *MinihyperProxy) routeChanges(diff *ConfigDiff, current, desired ProxyConfig) {
+	currentRoutes := make(map[string]RouteConfig)
+	for _, r := range current.Routes {
+		currentRoutes[routeKey(r.Route, r.RouteConditions)] = r
+	}
+	desiredRoutes := make(map[string]RouteConfig)
+	for _, r := range desired.Routes {
+		desiredRoutes[routeKey(r.Route, r.RouteConditions)] = r
+	}
+
+	name := current.Name
+	for _, r := range current.Routes {
+		r := r
+		key := routeKey(r.Route, r.RouteConditions)
+		if d, ok := desiredRoutes[key]; ok && sameRoute(d, r) {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: ActionRemoveRoute, Server: name, Key: key, Value: r.Target,
+			apply: func() *HttpError { return m.removeProxyRedirect(name, r.Route, r.RouteConditions) },
+			revert: func() *HttpError {
+				targetURL, _ := parseTarget(r.Target)
+				return m.addProxyRedirect(name, r.Route, targetURL, r.RouteOptions)
+			}})
+	}
+	for _, r := range desired.Routes {
+		r := r
+		key := routeKey(r.Route, r.RouteConditions)
+		if c, ok := currentRoutes[key]; ok && sameRoute(c, r) {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: ActionAddRoute, Server: name, Key: key, Value: r.Target,
+			apply: func() *HttpError {
+				targetURL, _ := parseTarget(r.Target)
+				return m.addProxyRedirect(name, r.Route, targetURL, r.RouteOptions)
+			},
+			revert: func() *HttpError { return m.removeProxyRedirect(name, r.Route, r.RouteConditions) }})
+	}
+}
+
+func sameOutgoingHop(a, b OutgoingHopConfig) bool {
+	return normalizeHopURL(a.Hop) == normalizeHopURL(b.Hop) && reflect.DeepEqual(a.HopOptions, b.HopOptions)
+}
+
+func (m *MinihyperProxy) hopChanges(diff *ConfigDiff, current, desired HopperConfig) {
+	name := current.Name
+
+	currentOutgoing := make(map[string]OutgoingHopConfig)
+	for _, o := range current.OutgoingHops {
+		currentOutgoing[hostnameOf(o.Target)] = o
+	}
+	desiredOutgoing := make(map[string]OutgoingHopConfig)
+	for _, o := range desired.OutgoingHops {
+		desiredOutgoing[hostnameOf(o.Target)] = o
+	}
+	for _, o := range current.OutgoingHops {
+		target, hop, options := o.Target, o.Hop, o.HopOptions
+		if d, ok := desiredOutgoing[hostnameOf(target)]; ok && sameOutgoingHop(d, o) {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: ActionRemoveOutgoingHop, Server: name, Key: target, Value: hop,
+			apply: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				return m.RemoveHop(name, targetURL)
+			},
+			revert: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				hopURL, _ := url.Parse(hop)
+				return m.AddHop(name, targetURL, hopURL, options)
+			}})
+	}
+	for _, o := range desired.OutgoingHops {
+		target, hop, options := o.Target, o.Hop, o.HopOptions
+		if c, ok := currentOutgoing[hostnameOf(target)]; ok && sameOutgoingHop(c, o) {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: ActionAddOutgoingHop, Server: name, Key: target, Value: hop,
+			apply: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				hopURL, _ := url.Parse(hop)
+				return m.AddHop(name, targetURL, hopURL, options)
+			},
+			revert: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				return m.RemoveHop(name, targetURL)
+			}})
+	}
+
+	currentIncoming := make(map[string]string)
+	for _, i := range current.IncomingHops {
+		currentIncoming[hostnameOf(i.Target)] = normalizeHopURL(i.Target)
+	}
+	desiredIncoming := make(map[string]string)
+	for _, i := range desired.IncomingHops {
+		desiredIncoming[hostnameOf(i.Target)] = normalizeHopURL(i.Target)
+	}
+	for _, i := range current.IncomingHops {
+		target := i.Target
+		if desiredTarget, ok := desiredIncoming[hostnameOf(target)]; ok && desiredTarget == normalizeHopURL(target) {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: ActionRemoveIncomingHop, Server: name, Key: target,
+			apply: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				return m.RemoveReceivedHop(name, targetURL)
+			},
+			revert: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				return m.ReceiveHop(name, targetURL, targetURL)
+			}})
+	}
+	for _, i := range desired.IncomingHops {
+		target := i.Target
+		if currentTarget, ok := currentIncoming[hostnameOf(target)]; ok && currentTarget == normalizeHopURL(target) {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{Action: ActionAddIncomingHop, Server: name, Key: target,
+			apply: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				return m.ReceiveHop(name, targetURL, targetURL)
+			},
+			revert: func() *HttpError {
+				targetURL, _ := url.Parse(target)
+				return m.RemoveReceivedHop(name, targetURL)
+			}})
+	}
+}
+
+func defaultHostname(hostname string) string {
+	if hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+// Ports left empty in the desired config match whatever was allocated.
+func samePort(desired, current string) bool {
+	return desired == "" || desired == current
+}
+
+func sameProxySettings(desired, current ProxyConfig) bool {
+	return defaultHostname(desired.Hostname) == current.Hostname && desired.Stopped == current.Stopped &&
+		samePort(desired.Port, current.Port) && reflect.DeepEqual(desired.ServerOptions, current.ServerOptions)
+}
+
+func sameHopperSettings(desired, current HopperConfig) bool {
+	return defaultHostname(desired.Hostname) == current.Hostname && desired.Stopped == current.Stopped &&
+		samePort(desired.IncomingPort, current.IncomingPort) && samePort(desired.OutgoingPort, current.OutgoingPort) &&
+		reflect.DeepEqual(desired.ServerOptions, current.ServerOptions)
+}
+
+// DiffConfig lists the changes that move the running servers to desired.
+// Servers whose hostname, type, options or stopped state changed are
+// replaced; every other server is patched in place so it keeps serving.
+func (m *MinihyperProxy) DiffConfig(file string, desired *Config) *ConfigDiff {
+	diff := &ConfigDiff{File: file, Time: time.Now()}
+	current := m.snapshotConfig()
+
+	currentProxies := make(map[string]ProxyConfig)
+	for _, p := range current.Proxies {
+		currentProxies[p.Name] = p
+	}
+	currentHoppers := make(map[string]HopperConfig)
+	for _, h := range current.Hoppers {
+		currentHoppers[h.Name] = h
+	}
+	desiredProxies := make(map[string]ProxyConfig)
+	for _, p := range desired.Proxies {
+		desiredProxies[p.Name] = p
+	}
+	desiredHoppers := make(map[string]HopperConfig)
+	for _, h := range desired.Hoppers {
+		desiredHoppers[h.Name] = h
+	}
+
+	for i := range current.Proxies {
+		p := current.Proxies[i]
+		if d, ok := desiredProxies[p.Name]; !ok || !sameProxySettings(d, p) {
+			m.removeServerChanges(diff, &p, nil)
+		}
+	}
+	for i := range current.Hoppers {
+		h := current.Hoppers[i]
+		if d, ok := desiredHoppers[h.Name]; !ok || !sameHopperSettings(d, h) {
+			m.removeServerChanges(diff, nil, &h)
+		}
+	}
+
+	for _, d := range desired.Proxies {
+		if p, ok := currentProxies[d.Name]; ok && sameProxySettings(d, p) {
+			m.routeChanges(diff, p, d)
+		}
+	}
+	for _, d := range desired.Hoppers {
+		if h, ok := currentHoppers[d.Name]; ok && sameHopperSettings(d, h) {
+			m.hopChanges(diff, h, d)
+		}
+	}
+
+	for i := range desired.Proxies {
+		d := desired.Proxies[i]
+		if p, ok := currentProxies[d.Name]; !ok || !sameProxySettings(d, p) {
+			m.addServerChanges(diff, &d, nil)
+		}
+	}
+	for i := range desired.Hoppers {
+		d := desired.Hoppers[i]
+		if h, ok := currentHoppers[d.Name]; !ok || !sameHopperSettings(d, h) {
+			m.addServerChanges(diff, nil, &d)
+		}
+	}
+	return diff
+}
+
+// ApplyConfigDiff applies every change in order and, if one fails, reverts
+// the ones already applied in reverse order.
+func (m *MinihyperProxy) ApplyConfigDiff(diff *ConfigDiff) error {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	return m.applyConfigDiff(diff)
+}
+
+func (m *MinihyperProxy) applyConfigDiff(diff *ConfigDiff) error {
+	for i, change := range diff.Changes {
+		m.InfoLog.Printf("Config reload: %v", change)
+		if httpErr := change.apply(); httpErr != nil {
+			diff.Error = fmt.Sprintf("%v: %v", change, httpErr)
+			m.ErrorLog.Printf("Config reload failed at %s, rolling back", diff.Error)
+			for j := i - 1; j >= 0; j-- {
+				if httpErr := diff.Changes[j].revert(); httpErr != nil {
+					m.ErrorLog.Printf("Could not roll back %v: %v", diff.Changes[j], httpErr)
+				}
+			}
+			diff.RolledBack = true
+			m.lastReload = diff
+			return fmt.Errorf("config reload failed: %s", diff.Error)
+		}
+	}
+	diff.Applied = true
+	m.lastReload = diff
+	m.InfoLog.Printf("Config reload from %s applied %d changes", diff.File, len(diff.Changes))
+	return nil
+}
+
+// ReloadConfig brings the running servers in line with the config file at
+// path, touching only what changed.
+func (m *MinihyperProxy) ReloadConfig(path string) (*ConfigDiff, error) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	config, err := LoadConfig(path)
+	if err != nil {
+		m.lastReload = &ConfigDiff{File: path, Time: time.Now(), Error: err.Error()}
+		return m.lastReload, err
+	}
+	diff := m.DiffConfig(path, config)
+	if err = m.applyConfigDiff(diff); err == nil {
+		m.configPath = path
+	}
+	return diff, err
+}
+
+// LastReload returns the outcome of the latest reload, nil if there was none.
+func (m *MinihyperProxy) LastReload() *ConfigDiff {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	return m.lastReload
+}
+
+// ConfigPath returns the config file reloads read from by default.
+func (m *MinihyperProxy) ConfigPath() string {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	return m.configPath
+}
+
+// WatchConfig reloads the config file at path on SIGHUP and whenever its
+// content changes, polling every interval. Call the returned function to stop
+// watching.
+func (m *MinihyperProxy) WatchConfig(path string, interval time.Duration) (stop func()) {
+	m.reloadLock.Lock()
+	m.configPath = path
+	m.reloadLock.Unlock()
+	done := make(chan struct{})
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	lastContent, _ := ioutil.ReadFile(path)
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-done:
+				return
+			case <-hangup:
+				m.InfoLog.Printf("SIGHUP received, reloading %s", path)
+			case <-ticker.C:
+				content, err := ioutil.ReadFile(path)
+				if err != nil || bytes.Equal(content, lastContent) {
+					continue
+				}
+				m.InfoLog.Printf("%s changed, reloading", path)
+			}
+			lastContent, _ = ioutil.ReadFile(path)
+			if _, err := m.ReloadConfig(path); err != nil {
+				m.ErrorLog.Printf(err.Error())
+			}
+		}
+	}()
+	return func() { close(done) }
+}
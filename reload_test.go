@@ -0,0 +1,112 @@
+package minihyperproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	file, err := ioutil.TempFile("", "mhp-config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`
+Proxies:
+  - Name: api
+    Routes:
+      - Route: /users
+        Target: http://localhost:9000/users
+      - Route: /orders
+        Target: http://localhost:9000/orders
+Hoppers:
+  - Name: edge
+    OutgoingHops:
+      - Target: http://www.example.com
+        Hop: http://localhost:7100
+`)
+	file.Close()
+
+	m := NewMinihyperProxy()
+	if err := m.ImportConfig(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.removeServer("api")
+	api := *m.Servers["api"]
+
+	ioutil.WriteFile(file.Name(), []byte(`
+Proxies:
+  - Name: api
+    Routes:
+      - Route: /users
+        Target: http://localhost:9000/users
+      - Route: /invoices
+        Target: http://localhost:9000/invoices
+Hoppers:
+  - Name: edge
+    IncomingHops:
+      - Target: http://www.example.org
+`), 0644)
+
+	diff, err := m.ReloadConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.removeServer("edge")
+
+	expected := []string{
+		"RemoveRoute api /orders -> http://localhost:9000/orders",
+		"AddRoute api /invoices -> http://localhost:9000/invoices",
+		"RemoveOutgoingHop edge http://www.example.com -> http://localhost:7100",
+		"AddIncomingHop edge http://www.example.org",
+	}
+	if len(diff.Changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), diff.Changes)
+	}
+	for i, change := range diff.Changes {
+		if change.String() != expected[i] {
+			t.Errorf("change %d: expected %q, got %q", i, expected[i], change.String())
+		}
+	}
+	if *m.Servers["api"] != api {
+		t.Error("api was restarted instead of patched")
+	}
+	proxyMap, _ := m.GetProxyMap("api")
+	if _, ok := proxyMap["/orders"]; ok || len(proxyMap) != 2 {
+		t.Errorf("unexpected routes after reload: %v", proxyMap)
+	}
+
+	if diff, _ := m.ReloadConfig(file.Name()); len(diff.Changes) != 0 {
+		t.Errorf("reloading an unchanged file should be a no-op, got %v", diff.Changes)
+	}
+}
+
+func TestReloadConfigRollback(t *testing.T) {
+	m := NewMinihyperProxy()
+	m.importConfig("test", &Config{Proxies: []ProxyConfig{{Name: "api", Routes: []RouteConfig{{Route: "/users", Target: "http://localhost:9000"}}}}})
+	defer m.removeServer("api")
+
+	diff := m.DiffConfig("test", &Config{
+		Proxies: []ProxyConfig{{Name: "api", Routes: []RouteConfig{{Route: "/orders", Target: "http://localhost:9000"}}}},
+		Hoppers: []HopperConfig{{Name: "edge"}},
+	})
+	diff.Changes = append(diff.Changes, ConfigChange{Action: "Fail", Server: "api",
+		apply:  func() *HttpError { return NoServerFoundError },
+		revert: func() *HttpError { return nil }})
+
+	if err := m.ApplyConfigDiff(diff); err == nil {
+		t.Fatal("expected the diff to fail")
+	}
+	if !diff.RolledBack || m.lastReload != diff {
+		t.Error("failed diff was not reported as rolled back")
+	}
+	if _, ok := m.Servers["edge"]; ok {
+		t.Error("edge should have been removed by the rollback")
+	}
+	proxyMap, _ := m.GetProxyMap("api")
+	if _, ok := proxyMap["/users"]; !ok || len(proxyMap) != 1 {
+		t.Errorf("routes were not rolled back: %v", proxyMap)
+	}
+}
@@ -0,0 +1,263 @@
+package minihyperproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Error classes a RetryPolicy can retry on.
+const (
+	RetryConnectFailure = "ConnectFailure"
+	RetryReset          = "Reset"
+	RetryTimeout        = "Timeout"
+)
+
+const retryBudgetBurst = 10
+
+// RetryPolicy retries the requests of a route that failed with one of the
+// RetryOn error classes or answered one of Statuses, on another target of the
+// pool when there is one. A request is retried only when its method is
+// idempotent or its body was buffered, and bodies past MaxBufferBytes are
+// never buffered. Budget caps retries to that percentage of the requests of
+// the route, past a burst of 10.
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"MaxAttempts,omitempty" yaml:"MaxAttempts,omitempty"`
+	RetryOn        []string `json:"RetryOn,omitempty" yaml:"RetryOn,omitempty"`
+	Statuses       []int    `json:"Statuses,omitempty" yaml:"Statuses,omitempty"`
+	PerTryTimeout  string   `json:"PerTryTimeout,omitempty" yaml:"PerTryTimeout,omitempty"`
+	Backoff        string   `json:"Backoff,omitempty" yaml:"Backoff,omitempty"`
+	MaxBackoff     string   `json:"MaxBackoff,omitempty" yaml:"MaxBackoff,omitempty"`
+	Budget         float64  `json:"Budget,omitempty" yaml:"Budget,omitempty"`
+	MaxBufferBytes int64    `json:"MaxBufferBytes,omitempty" yaml:"MaxBufferBytes,omitempty"`
+}
+
+type retrySettings struct {
+	maxAttempts    int
+	retryOn        map[string]bool
+	statuses       map[int]bool
+	perTryTimeout  time.Duration
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	budget         float64
+	maxBufferBytes int64
+	tokens         float64
+	random         *rand.Rand
+	lock           sync.Mutex
+}
+
+func (p *RetryPolicy) settings() (s *retrySettings, err error) {
+	s = &retrySettings{maxAttempts: orDefault(p.MaxAttempts, 3),
+		retryOn:        make(map[string]bool),
+		statuses:       make(map[int]bool),
+		budget:         p.Budget / 100,
+		maxBufferBytes: p.MaxBufferBytes,
+		tokens:         retryBudgetBurst,
+		random:         rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if s.maxAttempts < 1 {
+		return nil, fmt.Errorf("MaxAttempts must be positive")
+	}
+	if p.Budget < 0 {
+		return nil, fmt.Errorf("negative retry Budget")
+	}
+	if s.maxBufferBytes == 0 {
+		s.maxBufferBytes = 64 << 10
+	}
+	retryOn := p.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = []string{RetryConnectFailure, RetryReset, RetryTimeout}
+	}
+	for _, class := range retryOn {
+		switch class {
+		case RetryConnectFailure, RetryReset, RetryTimeout:
+			s.retryOn[class] = true
+		default:
+			return nil, fmt.Errorf("unknown RetryOn %q", class)
+		}
+	}
+	statuses := p.Statuses
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	for _, status := range statuses {
+		if status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid retry status %d", status)
+		}
+		s.statuses[status] = true
+	}
+	if s.perTryTimeout, err = parseDuration("PerTryTimeout", p.PerTryTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.backoff, err = parseDuration("Backoff", p.Backoff, 25*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if s.maxBackoff, err = parseDuration("MaxBackoff", p.MaxBackoff, 250*time.Millisecond); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// deposit credits the retry budget with a request.
+func (s *retrySettings) deposit() {
+	if s.budget == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tokens += s.budget; s.tokens > retryBudgetBurst {
+		s.tokens = retryBudgetBurst
+	}
+}
+
+// withdraw tells whether the retry budget allows one more retry.
+func (s *retrySettings) withdraw() bool {
+	if s.budget == 0 {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// delay is the backoff before the retry following try, with equal jitter.
+func (s *retrySettings) delay(try int) time.Duration {
+	d := s.backoff << uint(try-1)
+	if d > s.maxBackoff || d <= 0 {
+		d = s.maxBackoff
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return d/2 + time.Duration(s.random.Int63n(int64(d/2)+1))
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// buffer reads the body of req in memory so it can be sent again, and tells
+// whether req can be retried.
+func (s *retrySettings) buffer(req *http.Request) (body []byte, replayable bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, idempotent(req.Method)
+	}
+	if req.ContentLength > s.maxBufferBytes {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, s.maxBufferBytes+1))
+	if err != nil || int64(len(body)) > s.maxBufferBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+func errorClass(err error) string {
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return RetryTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return RetryConnectFailure
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return RetryTimeout
+	}
+	return RetryReset
+}
+
+// cancelBody ends the per-try timeout of a response once it has been read.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryTransport sends the requests of a route with a RetryPolicy, moving
+// the proxyAttempt to another upstream on each retry.
+type retryTransport struct {
+	server    *ProxyServer
+	route     *ProxyRoute
+	transport http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempt := req.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	policy := t.route.retry
+	var tried []*Upstream
+	for try := 1; ; try++ {
+		resp, err := t.try(req, policy)
+		retriable := false
+		if err != nil {
+			retriable = policy.retryOn[errorClass(err)]
+		} else {
+			retriable = policy.statuses[resp.StatusCode]
+		}
+		if !retriable || !attempt.replayable || try >= policy.maxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		tried = append(tried, attempt.upstream)
+		next := t.route.pool.pick(attempt.in, tried...)
+		if next == nil || !policy.withdraw() {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		attempt.upstream.end(true)
+		t.route.pool.observe(attempt.upstream, true)
+		attempt.upstream = next
+		next.begin()
+		t.server.infoLog.Printf("Retrying request to %v, attempt %d", next.URL.Host+next.URL.EscapedPath(), try+1)
+
+		select {
+		case <-time.After(policy.delay(try)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		req = req.Clone(req.Context())
+		if attempt.body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(attempt.body))
+		}
+		t.route.direct(req, attempt)
+	}
+}
+
+func (t *retryTransport) try(req *http.Request, policy *retrySettings) (*http.Response, error) {
+	// Upgraded connections outlive the request, so they get no timeout.
+	if policy.perTryTimeout == 0 || isUpgrade(req) {
+		return t.transport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), policy.perTryTimeout)
+	resp, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
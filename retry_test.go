@@ -0,0 +1,120 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var calls, unavailable int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.AddInt32(&unavailable, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("flaky " + string(body)))
+	}))
+	defer flaky.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	for _, body := range []string{
+		`{"Name": "api", "Route": "/refused", "Targets": [{"URL": "` + down.URL + `"}, {"URL": "` + ok.URL + `"}], "Retry": {"MaxAttempts": 2, "Backoff": "1ms"}}`,
+		`{"Name": "api", "Route": "/slow", "Targets": [{"URL": "` + slow.URL + `"}, {"URL": "` + ok.URL + `"}], "Retry": {"MaxAttempts": 2, "PerTryTimeout": "50ms", "Backoff": "1ms"}}`,
+		`{"Name": "api", "Route": "/flaky", "Target": "` + flaky.URL + `", "Retry": {"MaxAttempts": 3, "Backoff": "1ms", "MaxBufferBytes": 16}}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+			t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+		}
+	}
+	if resp := callAPI(t, api, "POST", "/proxy/route", `{"Name": "api", "Route": "/bad", "Target": "`+ok.URL+`", "Retry": {"RetryOn": ["Sometimes"]}}`); resp.Code != 422 {
+		t.Errorf("unknown RetryOn: expected 422, got %d", resp.Code)
+	}
+
+	proxyURL := "http://localhost:" + created.Port
+	for i := 0; i < 4; i++ {
+		if status, body := getBody(t, proxyURL+"/refused"); status != http.StatusOK || body != "ok" {
+			t.Errorf("refused connection not retried on the other target: %d %s", status, body)
+		}
+		if status, body := getBody(t, proxyURL+"/slow"); status != http.StatusOK || body != "ok" {
+			t.Errorf("timed out try not retried on the other target: %d %s", status, body)
+		}
+	}
+
+	atomic.StoreInt32(&unavailable, 2)
+	if status, body := getBody(t, proxyURL+"/flaky"); status != http.StatusOK || body != "flaky " || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("503 not retried on the only target: %d %s after %d calls", status, body, atomic.LoadInt32(&calls))
+	}
+
+	post := func(body string) (int, string) {
+		r, err := http.Post(proxyURL+"/flaky", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		answer, _ := ioutil.ReadAll(r.Body)
+		return r.StatusCode, string(answer)
+	}
+	atomic.StoreInt32(&unavailable, 1)
+	if status, body := post("buffered"); status != http.StatusOK || body != "flaky buffered" {
+		t.Errorf("buffered POST not replayed: %d %s", status, body)
+	}
+	atomic.StoreInt32(&unavailable, 1)
+	if status, _ := post("far too long to be buffered"); status != http.StatusServiceUnavailable {
+		t.Errorf("unbuffered POST retried: %d", status)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var calls int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	body := `{"Name": "api", "Route": "/svc", "Target": "` + unavailable.URL + `", "Retry": {"MaxAttempts": 2, "Backoff": "1ms", "Budget": 1}}`
+	if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+		t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+	}
+	for i := 0; i < 15; i++ {
+		if status, _ := getBody(t, "http://localhost:"+created.Port+"/svc"); status != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", status)
+		}
+	}
+	// The burst of 10 retries is spent, and 15 requests only earn 0.15 more.
+	if calls := atomic.LoadInt32(&calls); calls != 25 {
+		t.Errorf("expected 25 calls within the retry budget, got %d", calls)
+	}
+}
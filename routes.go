@@ -0,0 +1,431 @@
+package minihyperproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Route match kinds, listed in the order routes are tried in.
+const (
+	MatchExact    = "Exact"
+	MatchTemplate = "Template"
+	MatchRegex    = "Regex"
+	MatchPrefix   = "Prefix"
+)
+
+var matchRank = map[string]int{MatchExact: 0, MatchTemplate: 1, MatchRegex: 2, MatchPrefix: 3}
+
+// RouteConditions restrict a route to some requests. Host is either a
+// hostname or *.domain, matching any subdomain of domain. Headers and Query
+// values must be equal to the ones in the request, an empty value only asks
+// for the header or parameter to be present. Routes with the same path but
+// different conditions are different routes.
+type RouteConditions struct {
+	Host    string            `json:"Host,omitempty" yaml:"Host,omitempty"`
+	Methods []string          `json:"Methods,omitempty" yaml:"Methods,omitempty"`
+	Headers map[string]string `json:"Headers,omitempty" yaml:"Headers,omitempty"`
+	Query   map[string]string `json:"Query,omitempty" yaml:"Query,omitempty"`
+}
+
+// RouteOptions are the settings of a route beyond its path and target. Match
+// defaults to Template for routes containing {var} and to Exact otherwise.
+// A route forwards either to its single target or to the pool of Targets,
+// balanced by Balancer.
+type RouteOptions struct {
+	Match           string            `json:"Match,omitempty" yaml:"Match,omitempty"`
+	StripPrefix     bool              `json:"StripPrefix,omitempty" yaml:"StripPrefix,omitempty"`
+	Targets         []PoolTarget      `json:"Targets,omitempty" yaml:"Targets,omitempty"`
+	Balancer        string            `json:"Balancer,omitempty" yaml:"Balancer,omitempty"`
+	HashOn          string            `json:"HashOn,omitempty" yaml:"HashOn,omitempty"`
+	HealthCheck     *HealthCheck      `json:"HealthCheck,omitempty" yaml:"HealthCheck,omitempty"`
+	Outlier         *OutlierDetection `json:"Outlier,omitempty" yaml:"Outlier,omitempty"`
+	Retry           *RetryPolicy      `json:"Retry,omitempty" yaml:"Retry,omitempty"`
+	Breaker         *CircuitBreaker   `json:"Breaker,omitempty" yaml:"Breaker,omitempty"`
+	Upstream        *UpstreamOptions  `json:"Upstream,omitempty" yaml:"Upstream,omitempty"`
+	RouteConditions `yaml:",inline" mapstructure:",squash"`
+}
+
+func (o RouteOptions) matchKind(route string) string {
+	if o.Match != "" {
+		return o.Match
+	}
+	if strings.Contains(route, "{") {
+		return MatchTemplate
+	}
+	return MatchExact
+}
+
+// ProxyRoute is a route of a ProxyServer. Variables captured by Template and
+// Regex routes, by name or by group number for regexes, replace the matching
+// {var} placeholders in the target path.
+type ProxyRoute struct {
+	Route     string
+	Target    *url.URL
+	Options   RouteOptions
+	pattern   *regexp.Regexp
+	pool      *UpstreamPool
+	retry     *retrySettings
+	breaker   *breaker
+	transport *http.Transport
+	handler   http.HandlerFunc
+}
+
+type RouteInfo struct {
+	Priority int    `json:"Priority"`
+	Key      string `json:"Key"`
+	Route    string `json:"Route"`
+	Target   string `json:"Target,omitempty"`
+	RouteOptions
+	Upstreams    []UpstreamStats `json:"Upstreams,omitempty"`
+	BreakerState *BreakerStats   `json:"BreakerState,omitempty"`
+}
+
+func (c RouteConditions) isEmpty() bool {
+	return c.Host == "" && len(c.Methods) == 0 && len(c.Headers) == 0 && len(c.Query) == 0
+}
+
+func sortedStrings(m map[string]string) (pairs []string) {
+	for key, value := range m {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return
+}
+
+// routeKey identifies a route within its ProxyServer: the route itself when
+// it has no conditions, followed by its conditions otherwise.
+func routeKey(route string, c RouteConditions) string {
+	if c.isEmpty() {
+		return route
+	}
+	var conditions []string
+	if c.Host != "" {
+		conditions = append(conditions, "Host="+strings.ToLower(c.Host))
+	}
+	if len(c.Methods) > 0 {
+		methods := make([]string, len(c.Methods))
+		for i, method := range c.Methods {
+			methods[i] = strings.ToUpper(method)
+		}
+		sort.Strings(methods)
+		conditions = append(conditions, "Methods="+strings.Join(methods, ","))
+	}
+	for _, pair := range sortedStrings(c.Headers) {
+		conditions = append(conditions, "Header:"+pair)
+	}
+	for _, pair := range sortedStrings(c.Query) {
+		conditions = append(conditions, "Query:"+pair)
+	}
+	return route + " [" + strings.Join(conditions, " ") + "]"
+}
+
+func (c RouteConditions) validate() error {
+	host := strings.TrimPrefix(c.Host, "*.")
+	if strings.ContainsAny(host, "*:/ ") || (c.Host != "" && host == "") {
+		return fmt.Errorf("invalid Host %q", c.Host)
+	}
+	for _, method := range c.Methods {
+		if method == "" || strings.ContainsAny(method, " /") {
+			return fmt.Errorf("invalid method %q", method)
+		}
+	}
+	return nil
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func (c RouteConditions) matches(req *http.Request) bool {
+	if c.Host != "" {
+		host := strings.ToLower(hostWithoutPort(req.Host))
+		pattern := strings.ToLower(c.Host)
+		if strings.HasPrefix(pattern, "*.") {
+			if !strings.HasSuffix(host, pattern[1:]) {
+				return false
+			}
+		} else if host != pattern {
+			return false
+		}
+	}
+	if len(c.Methods) > 0 {
+		allowed := false
+		for _, method := range c.Methods {
+			allowed = allowed || strings.EqualFold(method, req.Method)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for name, value := range c.Headers {
+		if values, ok := req.Header[http.CanonicalHeaderKey(name)]; !ok || (value != "" && !contains(values, value)) {
+			return false
+		}
+	}
+	if len(c.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range c.Query {
+			if values, ok := query[name]; !ok || (value != "" && !contains(values, value)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hostRank sorts exact hosts before wildcards, longer wildcards first, and
+// routes for any host last.
+func (c RouteConditions) hostRank() int {
+	switch {
+	case c.Host == "":
+		return 0
+	case strings.HasPrefix(c.Host, "*."):
+		return len(c.Host)
+	}
+	return 1 << 16
+}
+
+func (c RouteConditions) count() int {
+	count := len(c.Headers) + len(c.Query)
+	if len(c.Methods) > 0 {
+		count++
+	}
+	return count
+}
+
+func newProxyRoute(route string, target *url.URL, options RouteOptions) (r *ProxyRoute, err error) {
+	r = &ProxyRoute{Route: route, Target: target, Options: options}
+	switch options.matchKind(route) {
+	case MatchExact, MatchPrefix:
+		if !strings.HasPrefix(route, "/") {
+			err = fmt.Errorf("route %q must start with /", route)
+		}
+	case MatchTemplate:
+		if !strings.HasPrefix(route, "/") {
+			err = fmt.Errorf("route %q must start with /", route)
+		} else {
+			err = mux.NewRouter().Path(route).GetError()
+		}
+	case MatchRegex:
+		r.pattern, err = regexp.Compile(route)
+	default:
+		err = fmt.Errorf("unknown Match %q", options.Match)
+	}
+	if err == nil && options.StripPrefix && options.matchKind(route) != MatchPrefix {
+		err = fmt.Errorf("StripPrefix only applies to Prefix routes")
+	}
+	if err == nil {
+		err = options.validate()
+	}
+	if err == nil {
+		targets := options.Targets
+		if target != nil {
+			if len(targets) > 0 {
+				return nil, fmt.Errorf("a route takes either Target or Targets")
+			}
+			targets = []PoolTarget{{URL: target.String()}}
+		}
+		if r.pool, err = newUpstreamPool(targets, options.Balancer, options.HashOn); err == nil {
+			err = r.pool.configureHealth(options)
+		}
+	}
+	if err == nil && options.Retry != nil {
+		r.retry, err = options.Retry.settings()
+	}
+	if err == nil && options.Breaker != nil {
+		r.breaker, err = options.Breaker.newBreaker()
+	}
+	if err == nil && options.Upstream != nil {
+		_, err = options.Upstream.settings()
+	}
+	return
+}
+
+// parseTarget parses the single target of a route, which is nil for routes
+// to a pool.
+func parseTarget(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	return url.Parse(raw)
+}
+
+func validateRoute(route string, target *url.URL, options RouteOptions) error {
+	_, err := newProxyRoute(route, target, options)
+	return err
+}
+
+// close stops the health checks of a route replaced or deleted and drops
+// its idle upstream connections.
+func (r *ProxyRoute) close() {
+	if r.pool != nil {
+		r.pool.stopHealthChecks()
+	}
+	if r.transport != nil {
+		r.transport.CloseIdleConnections()
+	}
+}
+
+func (r *ProxyRoute) kind() string {
+	return r.Options.matchKind(r.Route)
+}
+
+// literalLength is the length of the route without its {var} patterns, so
+// more specific templates sort first.
+func (r *ProxyRoute) literalLength() (length int) {
+	depth := 0
+	for _, c := range r.Route {
+		switch {
+		case c == '{':
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+		case depth == 0:
+			length++
+		}
+	}
+	return
+}
+
+func (r *ProxyRoute) key() string {
+	return routeKey(r.Route, r.Options.RouteConditions)
+}
+
+// routeBefore orders routes by host, as virtual hosts are picked before
+// paths, then match kind, longest literal route, number of other conditions
+// and finally alphabetically, so the first matching route wins regardless of
+// the order routes were added in.
+func routeBefore(a, b *ProxyRoute) bool {
+	if hostA, hostB := a.Options.hostRank(), b.Options.hostRank(); hostA != hostB {
+		return hostA > hostB
+	}
+	if rankA, rankB := matchRank[a.kind()], matchRank[b.kind()]; rankA != rankB {
+		return rankA < rankB
+	}
+	if lengthA, lengthB := a.literalLength(), b.literalLength(); lengthA != lengthB {
+		return lengthA > lengthB
+	}
+	if countA, countB := a.Options.count(), b.Options.count(); countA != countB {
+		return countA > countB
+	}
+	return a.key() < b.key()
+}
+
+func sortRoutes(routes map[string]*ProxyRoute) []*ProxyRoute {
+	sorted := make([]*ProxyRoute, 0, len(routes))
+	for _, r := range routes {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return routeBefore(sorted[i], sorted[j]) })
+	return sorted
+}
+
+func (r *ProxyRoute) register(router *mux.Router) {
+	var route *mux.Route
+	switch r.kind() {
+	case MatchExact:
+		route = router.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return req.URL.Path == r.Route
+		})
+	case MatchTemplate:
+		route = router.Path(r.Route)
+	case MatchRegex:
+		route = router.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return r.pattern.MatchString(req.URL.Path)
+		})
+	case MatchPrefix:
+		route = router.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return r.hasPrefix(req.URL.Path)
+		})
+	}
+	if !r.Options.RouteConditions.isEmpty() {
+		route = route.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+			return r.Options.matches(req)
+		})
+	}
+	route.HandlerFunc(r.handler)
+}
+
+// hasPrefix matches whole path segments, so /api does not match /apiary.
+func (r *ProxyRoute) hasPrefix(path string) bool {
+	prefix := strings.TrimSuffix(r.Route, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (r *ProxyRoute) vars(req *http.Request) map[string]string {
+	if r.kind() == MatchTemplate {
+		return mux.Vars(req)
+	}
+	vars := make(map[string]string)
+	if r.kind() == MatchRegex {
+		match := r.pattern.FindStringSubmatch(req.URL.Path)
+		names := r.pattern.SubexpNames()
+		for i := 1; i < len(match); i++ {
+			vars[strconv.Itoa(i)] = match[i]
+			if names[i] != "" {
+				vars[names[i]] = match[i]
+			}
+		}
+	}
+	return vars
+}
+
+// targetPath is the path on target for req: the target path with variables
+// substituted for Template and Regex routes, the target path joined with the
+// request path, without the route if StripPrefix is set, for Prefix routes.
+func (r *ProxyRoute) targetPath(req *http.Request, target *url.URL) string {
+	if r.kind() == MatchPrefix {
+		path := req.URL.Path
+		if r.Options.StripPrefix {
+			path = strings.TrimPrefix(path, strings.TrimSuffix(r.Route, "/"))
+		}
+		if target.Path == "" {
+			return singleJoiningSlash("/", path)
+		}
+		if path == "" {
+			return target.Path
+		}
+		return singleJoiningSlash(target.Path, path)
+	}
+	path := target.Path
+	for name, value := range r.vars(req) {
+		path = strings.Replace(path, "{"+name+"}", value, -1)
+	}
+	return path
+}
+
+func (r *ProxyRoute) info(priority int) RouteInfo {
+	info := RouteInfo{Priority: priority, Key: r.key(), Route: r.Route, RouteOptions: r.Options}
+	info.Match = r.kind()
+	info.Upstream = r.Options.Upstream.redacted()
+	if r.Target != nil {
+		info.Target = r.Target.String()
+	}
+	if r.pool != nil {
+		info.Upstreams = r.pool.stats()
+	}
+	if r.breaker != nil {
+		info.BreakerState = r.breaker.stats()
+	}
+	return info
+}
@@ -0,0 +1,168 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteMatching(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	for _, body := range []string{
+		`{"Name": "api", "Route": "/api", "Target": "` + upstream.URL + `/v1", "Match": "Prefix", "StripPrefix": true}`,
+		`{"Name": "api", "Route": "/static", "Target": "` + upstream.URL + `", "Match": "Prefix"}`,
+		`{"Name": "api", "Route": "/api/health", "Target": "` + upstream.URL + `/healthz"}`,
+		`{"Name": "api", "Route": "/users/{id:[0-9]+}", "Target": "` + upstream.URL + `/accounts/{id}"}`,
+		`{"Name": "api", "Route": "^/orders/(?P<order>[0-9]+)/items/([0-9]+)$", "Target": "` + upstream.URL + `/o/{order}/i/{2}", "Match": "Regex"}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+			t.Fatalf("create route %s: %d %s", body, resp.Code, resp.Body)
+		}
+	}
+
+	proxyURL := "http://localhost:" + created.Port
+	for path, expected := range map[string]string{
+		"/api/users/42?page=2":    "/v1/users/42?page=2",
+		"/api":                    "/v1",
+		"/api/health":             "/healthz",
+		"/static/css/site.css":    "/static/css/site.css",
+		"/users/7":                "/accounts/7",
+		"/orders/12/items/3":      "/o/12/i/3",
+		"/apiary":                 "404",
+		"/users/seven":            "404",
+		"/orders/12/items/3/more": "404",
+	} {
+		r, err := http.Get(proxyURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if expected == "404" {
+			if r.StatusCode != http.StatusNotFound {
+				t.Errorf("%s: expected 404, got %d %s", path, r.StatusCode, body)
+			}
+		} else if string(body) != expected {
+			t.Errorf("%s: expected upstream to see %s, got %d %s", path, expected, r.StatusCode, body)
+		}
+	}
+
+	listed := ProxyMapResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy/route", `{"Name": "api"}`).Body.Bytes(), &listed)
+	order := []string{"/api/health", "/users/{id:[0-9]+}", "^/orders/(?P<order>[0-9]+)/items/([0-9]+)$", "/static", "/api"}
+	if len(listed.Routes) != len(order) {
+		t.Fatalf("expected %d routes, got %+v", len(order), listed.Routes)
+	}
+	for i, route := range order {
+		if listed.Routes[i].Route != route || listed.Routes[i].Priority != i+1 {
+			t.Errorf("expected %s at priority %d, got %+v", route, i+1, listed.Routes[i])
+		}
+	}
+	if listed.Routes[0].Match != MatchExact || listed.Routes[1].Match != MatchTemplate {
+		t.Errorf("default match kinds not reported: %+v", listed.Routes[:2])
+	}
+
+	for _, body := range []string{
+		`{"Name": "api", "Route": "^/broken(", "Target": "` + upstream.URL + `", "Match": "Regex"}`,
+		`{"Name": "api", "Route": "/exact", "Target": "` + upstream.URL + `", "StripPrefix": true}`,
+		`{"Name": "api", "Route": "/x", "Target": "` + upstream.URL + `", "Match": "Glob"}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != 422 {
+			t.Errorf("invalid route %s: expected 422, got %d %s", body, resp.Code, resp.Body)
+		}
+	}
+}
+
+func TestVirtualHostRouting(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "front"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("front")
+
+	for _, body := range []string{
+		`{"Name": "front", "Route": "/", "Target": "` + upstream.URL + `/default", "Match": "Prefix"}`,
+		`{"Name": "front", "Route": "/", "Target": "` + upstream.URL + `/api", "Match": "Prefix", "Host": "api.local"}`,
+		`{"Name": "front", "Route": "/", "Target": "` + upstream.URL + `/admin", "Match": "Prefix", "Host": "admin.local"}`,
+		`{"Name": "front", "Route": "/", "Target": "` + upstream.URL + `/tenant", "Match": "Prefix", "Host": "*.tenants.local"}`,
+		`{"Name": "front", "Route": "/items", "Target": "` + upstream.URL + `/write", "Host": "api.local", "Methods": ["POST", "put"]}`,
+		`{"Name": "front", "Route": "/items", "Target": "` + upstream.URL + `/v2", "Host": "api.local", "Headers": {"X-Version": "2"}}`,
+		`{"Name": "front", "Route": "/search", "Target": "` + upstream.URL + `/beta", "Query": {"beta": ""}}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+			t.Fatalf("create route %s: %d %s", body, resp.Code, resp.Body)
+		}
+	}
+
+	send := func(method, host, path string, header http.Header) string {
+		req, _ := http.NewRequest(method, "http://localhost:"+created.Port+path, nil)
+		req.Host = host
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		body, _ := ioutil.ReadAll(r.Body)
+		return string(body)
+	}
+
+	for _, c := range []struct {
+		method, host, path string
+		header             http.Header
+		expected           string
+	}{
+		{"GET", "api.local", "/items", nil, "/api/items"},
+		{"GET", "API.local:8080", "/users", nil, "/api/users"},
+		{"POST", "api.local", "/items", nil, "/write"},
+		{"PUT", "api.local", "/items", nil, "/write"},
+		{"GET", "api.local", "/items", http.Header{"X-Version": {"2"}}, "/v2"},
+		{"GET", "api.local", "/items", http.Header{"X-Version": {"1"}}, "/api/items"},
+		{"GET", "admin.local", "/items", nil, "/admin/items"},
+		{"GET", "acme.tenants.local", "/", nil, "/tenant/"},
+		{"GET", "tenants.local", "/", nil, "/default/"},
+		{"GET", "other.local", "/search?beta", nil, "/beta"},
+		{"GET", "other.local", "/search", nil, "/default/search"},
+	} {
+		if got := send(c.method, c.host, c.path, c.header); got != c.expected {
+			t.Errorf("%s %s%s %v: expected %s, got %s", c.method, c.host, c.path, c.header, c.expected, got)
+		}
+	}
+
+	listed := ProxyMapResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy/route", `{"Name": "front"}`).Body.Bytes(), &listed)
+	if len(listed.Routes) != 7 || listed.Routes[0].Host != "api.local" || listed.Routes[6].Key != "/" {
+		t.Errorf("unexpected route order %+v", listed.Routes)
+	}
+
+	if resp := callAPI(t, api, "DELETE", "/proxy/route", `{"Name": "front", "Route": "/", "Host": "admin.local"}`); resp.Code != http.StatusOK {
+		t.Fatalf("delete admin route: %d %s", resp.Code, resp.Body)
+	}
+	if got := send("GET", "admin.local", "/items", nil); got != "/default/items" {
+		t.Errorf("admin.local still routed after delete: %s", got)
+	}
+	if got := send("GET", "api.local", "/users", nil); got != "/api/users" {
+		t.Errorf("deleting admin.local removed api.local: %s", got)
+	}
+}
@@ -1,7 +1,15 @@
 package minihyperproxy
 
+const (
+	StatusDown     = "Down"
+	StatusStarting = "Starting"
+	StatusUp       = "Up"
+	StatusDraining = "Draining"
+	StatusFailed   = "Failed"
+)
+
 type Server interface {
-	Serve()
+	Serve() error
 	Stop()
 	Info() *map[string]interface{}
 }
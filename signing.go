@@ -0,0 +1,172 @@
+package minihyperproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of the hop envelope, covered by the signature along with the
+// method of the request.
+var signedHopHeaders = []string{"X-MHP-Target-Host", "X-MHP-Target-Scheme", "X-MHP-Target-Path", "X-MHP-Target-Query",
+	"X-MHP-Forwarded-Host", "X-MHP-Hop-Route", "X-MHP-Hop-Ids", "X-MHP-Hop-TTL", "X-MHP-Hop-Path",
+	"X-MHP-Hop-Timestamp", "X-MHP-Hop-Nonce", "X-MHP-Hop-Lease", "X-MHP-Gossip-Digest"}
+
+// HopSigning signs the hops leaving a hopper, with an HMAC of SharedKey or
+// with the Ed25519 PrivateKey, and verifies the hops reaching it against
+// SharedKey or any of the Ed25519 PeerKeys. Keys other than SharedKey are
+// base64 encoded. Hops signed more than MaxSkew, 30s by default, away from
+// now or whose nonce was seen already are rejected, as are unsigned hops
+// unless the hopper has nothing to verify them with.
+type HopSigning struct {
+	SharedKey  string   `json:"SharedKey,omitempty" yaml:"SharedKey,omitempty"`
+	PrivateKey string   `json:"PrivateKey,omitempty" yaml:"PrivateKey,omitempty"`
+	PeerKeys   []string `json:"PeerKeys,omitempty" yaml:"PeerKeys,omitempty"`
+	MaxSkew    string   `json:"MaxSkew,omitempty" yaml:"MaxSkew,omitempty"`
+}
+
+type hopSigner struct {
+	sharedKey  []byte
+	privateKey ed25519.PrivateKey
+	peerKeys   []ed25519.PublicKey
+	maxSkew    time.Duration
+
+	lock      sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func (o *HopSigning) settings() (s *hopSigner, err error) {
+	s = &hopSigner{sharedKey: []byte(o.SharedKey), nonces: make(map[string]time.Time), lastSweep: time.Now()}
+	if o.PrivateKey != "" {
+		key, err := base64.StdEncoding.DecodeString(o.PrivateKey)
+		if err != nil || (len(key) != ed25519.SeedSize && len(key) != ed25519.PrivateKeySize) {
+			return nil, fmt.Errorf("PrivateKey must be a base64 Ed25519 seed or private key")
+		}
+		s.privateKey = ed25519.NewKeyFromSeed(key[:ed25519.SeedSize])
+	}
+	for _, peerKey := range o.PeerKeys {
+		key, err := base64.StdEncoding.DecodeString(peerKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid peer key %q", peerKey)
+		}
+		s.peerKeys = append(s.peerKeys, ed25519.PublicKey(key))
+	}
+	if len(s.sharedKey) == 0 && s.privateKey == nil && len(s.peerKeys) == 0 {
+		return nil, fmt.Errorf("HopSigning needs a SharedKey, a PrivateKey or PeerKeys")
+	}
+	if s.maxSkew, err = parseDuration("MaxSkew", o.MaxSkew, 30*time.Second); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func envelope(req *http.Request) []byte {
+	var b strings.Builder
+	b.WriteString("MHP1\n" + req.Method + "\n")
+	for _, header := range signedHopHeaders {
+		b.WriteString(req.Header.Get(header) + "\n")
+	}
+	return []byte(b.String())
+}
+
+func (s *hopSigner) mac(envelope []byte) []byte {
+	mac := hmac.New(sha256.New, s.sharedKey)
+	mac.Write(envelope)
+	return mac.Sum(nil)
+}
+
+// sign stamps req with a fresh timestamp and nonce and signs its envelope.
+func (s *hopSigner) sign(req *http.Request) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	req.Header.Set("X-MHP-Hop-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set("X-MHP-Hop-Nonce", hex.EncodeToString(nonce))
+	switch {
+	case s.privateKey != nil:
+		req.Header.Set("X-MHP-Hop-Signature", "ed25519="+base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, envelope(req))))
+	case len(s.sharedKey) > 0:
+		req.Header.Set("X-MHP-Hop-Signature", "hmac-sha256="+base64.StdEncoding.EncodeToString(s.mac(envelope(req))))
+	}
+}
+
+func (s *hopSigner) verifies() bool {
+	return len(s.sharedKey) > 0 || len(s.peerKeys) > 0
+}
+
+// verify checks the signature, timestamp and nonce of req.
+func (s *hopSigner) verify(req *http.Request) error {
+	parts := strings.SplitN(req.Header.Get("X-MHP-Hop-Signature"), "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("unsigned hop")
+	}
+	signature, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed signature")
+	}
+	valid := false
+	switch parts[0] {
+	case "hmac-sha256":
+		valid = len(s.sharedKey) > 0 && hmac.Equal(signature, s.mac(envelope(req)))
+	case "ed25519":
+		for _, key := range s.peerKeys {
+			if valid = ed25519.Verify(key, envelope(req), signature); valid {
+				break
+			}
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid signature")
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get("X-MHP-Hop-Timestamp"), 10, 64)
+	now := time.Now()
+	if skew := now.Sub(time.Unix(timestamp, 0)); err != nil || skew > s.maxSkew || skew < -s.maxSkew {
+		return fmt.Errorf("stale signature")
+	}
+	nonce := req.Header.Get("X-MHP-Hop-Nonce")
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.lastSweep) > s.maxSkew {
+		for seen, expiry := range s.nonces {
+			if now.After(expiry) {
+				delete(s.nonces, seen)
+			}
+		}
+		s.lastSweep = now
+	}
+	if _, seen := s.nonces[nonce]; seen || nonce == "" {
+		return fmt.Errorf("replayed hop")
+	}
+	// Past this, the timestamp check rejects the nonce anyway.
+	s.nonces[nonce] = time.Unix(timestamp, 0).Add(s.maxSkew)
+	return nil
+}
+
+func (h *HopperServer) getSigner() *hopSigner {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.signer
+}
+
+// verifyOrReject verifies the signature of an incoming hop, answering 403 if
+// that fails.
+func (h *HopperServer) verifyOrReject(resp http.ResponseWriter, req *http.Request) bool {
+	if signer := h.getSigner(); signer != nil && signer.verifies() {
+		if err := signer.verify(req); err != nil {
+			h.warnLog.Printf("Rejected hop from %v: %v", req.RemoteAddr, err)
+			resp.WriteHeader(http.StatusForbidden)
+			resp.Write([]byte("403 - " + err.Error()))
+			return false
+		}
+	}
+	return true
+}
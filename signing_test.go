@@ -0,0 +1,116 @@
+package minihyperproxy
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignedHops(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-MHP-Hop-Signature") != "" {
+			t.Errorf("signature leaked to the target")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	var captured http.Header
+	capture := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured = r.Header.Clone()
+	}))
+	defer capture.Close()
+	captureURL, _ := url.Parse(capture.URL)
+
+	edgePublic, edgePrivate, _ := ed25519.GenerateKey(nil)
+	otherPublic, _, _ := ed25519.GenerateKey(nil)
+	encode := base64.StdEncoding.EncodeToString
+	m := NewMinihyperProxy()
+	ports := make(map[string][]string)
+	for name, signing := range map[string]*HopSigning{
+		"a":        {SharedKey: "s3cret"},
+		"b":        {SharedKey: "s3cret"},
+		"edge":     {PrivateKey: encode(edgePrivate.Seed())},
+		"core":     {PeerKeys: []string{encode(edgePublic)}},
+		"stranger": {PeerKeys: []string{encode(otherPublic)}},
+	} {
+		incomingPort, outgoingPort, _, httpErr := m.startHopperServer(name, "", "", "", ServerOptions{HopSigning: signing})
+		if httpErr != nil {
+			t.Fatalf("start %s: %v", name, httpErr)
+		}
+		defer m.removeServer(name)
+		ports[name] = []string{incomingPort, outgoingPort}
+		m.ReceiveHop(name, upstreamURL, upstreamURL)
+	}
+	hopURL := func(name string) *url.URL { return &url.URL{Scheme: "http", Host: "localhost:" + ports[name][0]} }
+	get := func(name string) int {
+		status, _ := getBody(t, "http://localhost:"+ports[name][1]+"/"+upstreamURL.Hostname()+"/")
+		return status
+	}
+
+	m.AddHop("a", upstreamURL, hopURL("b"), HopOptions{})
+	m.AddHop("edge", upstreamURL, hopURL("core"), HopOptions{})
+	if status := get("a"); status != http.StatusOK {
+		t.Errorf("HMAC signed hop: expected 200, got %d", status)
+	}
+	if status := get("edge"); status != http.StatusOK {
+		t.Errorf("Ed25519 signed hop: expected 200, got %d", status)
+	}
+	m.AddHop("edge", upstreamURL, hopURL("stranger"), HopOptions{})
+	if status := get("edge"); status != http.StatusForbidden {
+		t.Errorf("hop signed by an unknown key: expected 403, got %d", status)
+	}
+
+	send := func(header http.Header) int {
+		req, _ := http.NewRequest("GET", hopURL("b").String(), nil)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send(http.Header{"X-Mhp-Target-Host": {upstreamURL.Hostname()}}); status != http.StatusForbidden {
+		t.Errorf("unsigned hop: expected 403, got %d", status)
+	}
+
+	m.AddHop("a", upstreamURL, &url.URL{Scheme: "http", Host: captureURL.Host}, HopOptions{})
+	get("a")
+	tampered := captured.Clone()
+	tampered.Set("X-MHP-Target-Path", "admin")
+	if status := send(tampered); status != http.StatusForbidden {
+		t.Errorf("tampered hop: expected 403, got %d", status)
+	}
+	if status := send(captured.Clone()); status != http.StatusOK {
+		t.Errorf("captured hop: expected 200, got %d", status)
+	}
+	if status := send(captured.Clone()); status != http.StatusForbidden {
+		t.Errorf("replayed hop: expected 403, got %d", status)
+	}
+
+	stale := captured.Clone()
+	stale.Set("X-MHP-Hop-Nonce", "fresh")
+	stale.Set("X-MHP-Hop-Timestamp", strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	signer, _ := (&HopSigning{SharedKey: "s3cret"}).settings()
+	req := &http.Request{Method: "GET", Header: stale}
+	stale.Set("X-MHP-Hop-Signature", "hmac-sha256="+encode(signer.mac(envelope(req))))
+	if status := send(stale); status != http.StatusForbidden {
+		t.Errorf("stale hop: expected 403, got %d", status)
+	}
+
+	api := BuildAPI(m)
+	for path, body := range map[string]string{
+		"/hopper": `{"Name": "bad", "HopSigning": {"PrivateKey": "short"}}`,
+		"/proxy":  `{"Name": "bad", "HopSigning": {"SharedKey": "s3cret"}}`,
+	} {
+		if resp := callAPI(t, api, "POST", path, body); resp.Code != 422 {
+			t.Errorf("%s %s: expected 422, got %d", path, body, resp.Code)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package minihyperproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	OpCreateProxy  = "CreateProxy"
+	OpCreateRoute  = "CreateRoute"
+	OpCreateHopper = "CreateHopper"
+	OpAddHop       = "AddHop"
+	OpReceiveHop   = "ReceiveHop"
+	OpStopServer   = "StopServer"
+	OpStartServer  = "StartServer"
+	OpSetTLS       = "SetTLS"
+
+	OpRemoveServer      = "RemoveServer"
+	OpRemoveRoute       = "RemoveRoute"
+	OpRemoveHop         = "RemoveHop"
+	OpRemoveReceivedHop = "RemoveReceivedHop"
+)
+
+const (
+	journalFile  = "journal.log"
+	snapshotFile = "snapshot.json"
+)
+
+// StoreRecord is a single mutation journaled by the Store.
+type StoreRecord struct {
+	Seq           uint64         `json:"Seq"`
+	Op            string         `json:"Op"`
+	Name          string         `json:"Name"`
+	Hostname      string         `json:"Hostname,omitempty"`
+	Route         string         `json:"Route,omitempty"`
+	Target        string         `json:"Target,omitempty"`
+	Hop           string         `json:"Hop,omitempty"`
+	Ports         []string       `json:"Ports,omitempty"`
+	Options       *RouteOptions  `json:"Options,omitempty"`
+	HopOptions    *HopOptions    `json:"HopOptions,omitempty"`
+	ServerOptions *ServerOptions `json:"ServerOptions,omitempty"`
+}
+
+func (r StoreRecord) serverOptions() ServerOptions {
+	if r.ServerOptions == nil {
+		return ServerOptions{}
+	}
+	return *r.ServerOptions
+}
+
+type storeSnapshot struct {
+	Seq    uint64  `json:"Seq"`
+	Config *Config `json:"Config"`
+}
+
+// Store persists MinihyperProxy mutations in an append-only journal. Every
+// journal line is prefixed with its CRC32 so a write torn by a crash is
+// detected and dropped on the next open. Compaction writes the whole state to
+// a snapshot, atomically renamed into place, and empties the journal; records
+// already covered by the snapshot are recognised by their sequence number.
+type Store struct {
+	CompactEvery int
+	dir          string
+	journal      *os.File
+	mu           sync.Mutex
+	seq          uint64
+	pending      int
+	snapshot     *Config
+	records      []StoreRecord
+}
+
+func OpenStore(dir string) (s *Store, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	s = &Store{CompactEvery: 100, dir: dir}
+	if err = s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err = s.loadJournal(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *Store) loadSnapshot() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		s.snapshot = &Config{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	snapshot := storeSnapshot{}
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("corrupt snapshot %s: %v", filepath.Join(s.dir, snapshotFile), err)
+	}
+	s.seq = snapshot.Seq
+	s.snapshot = snapshot.Config
+	if s.snapshot == nil {
+		s.snapshot = &Config{}
+	}
+	return nil
+}
+
+func decodeJournalLine(line []byte) (record StoreRecord, ok bool) {
+	if len(line) < 10 || line[8] != ' ' || line[len(line)-1] != '\n' {
+		return
+	}
+	var checksum uint32
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &checksum); err != nil {
+		return
+	}
+	payload := line[9 : len(line)-1]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return
+	}
+	return record, true
+}
+
+func (s *Store) loadJournal() error {
+	path := filepath.Join(s.dir, journalFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	var validSize int64
+	snapshotSeq := s.seq
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			f.Close()
+			return err
+		}
+		record, ok := decodeJournalLine(line)
+		if !ok {
+			break
+		}
+		validSize += int64(len(line))
+		s.pending++
+		if record.Seq > snapshotSeq {
+			s.records = append(s.records, record)
+			s.seq = record.Seq
+		}
+	}
+
+	// Drop whatever follows the last intact record: it was torn by a crash.
+	if err = f.Truncate(validSize); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Seek(validSize, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	s.journal = f
+	return nil
+}
+
+// State returns the snapshot and the journaled records that followed it at
+// the time the store was opened.
+func (s *Store) State() (*Config, []StoreRecord) {
+	return s.snapshot, s.records
+}
+
+func (s *Store) Append(record StoreRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.Seq = s.seq + 1
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%08x ", crc32.ChecksumIEEE(payload))
+	line.Write(payload)
+	line.WriteByte('\n')
+
+	if _, err = s.journal.Write(line.Bytes()); err != nil {
+		return err
+	}
+	if err = s.journal.Sync(); err != nil {
+		return err
+	}
+	s.seq = record.Seq
+	s.pending++
+	return nil
+}
+
+func (s *Store) needsCompaction() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.CompactEvery > 0 && s.pending >= s.CompactEvery
+}
+
+// Compact replaces the snapshot with config, which must reflect every record
+// appended so far, and empties the journal.
+func (s *Store) Compact(config *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(storeSnapshot{Seq: s.seq, Config: config}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(s.dir, snapshotFile+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// A crash before the truncation leaves records the snapshot already
+	// covers; loadJournal skips them by sequence number.
+	if err = s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.pending = 0
+	return s.journal.Sync()
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.journal.Close()
+}
+
+// UseStore replays the state persisted in dir and journals every following
+// mutation there.
+func (m *MinihyperProxy) UseStore(dir string) error {
+	store, err := OpenStore(dir)
+	if err != nil {
+		return err
+	}
+
+	snapshot, records := store.State()
+	m.InfoLog.Printf("Replaying state from %s: %d servers, %d journaled records", dir, len(snapshot.Proxies)+len(snapshot.Hoppers), len(records))
+	// A server that cannot start, say because its port was taken meanwhile,
+	// is skipped rather than costing the others their state.
+	file := filepath.Join(dir, snapshotFile)
+	for _, p := range snapshot.Proxies {
+		if err := m.importConfig(file, &Config{Proxies: []ProxyConfig{p}}); err != nil {
+			m.WarnLog.Printf("Skipping proxy %s of the snapshot: %v", p.Name, err)
+		}
+	}
+	for _, h := range snapshot.Hoppers {
+		if err := m.importConfig(file, &Config{Hoppers: []HopperConfig{h}}); err != nil {
+			m.WarnLog.Printf("Skipping hopper %s of the snapshot: %v", h.Name, err)
+		}
+	}
+	for _, record := range records {
+		if httpErr := m.applyRecord(record); httpErr != nil {
+			m.WarnLog.Printf("Skipping journal record %d (%s %s): %v", record.Seq, record.Op, record.Name, httpErr)
+		}
+	}
+	m.store = store
+	return nil
+}
+
+func (m *MinihyperProxy) applyRecord(record StoreRecord) (httpErr *HttpError) {
+	switch record.Op {
+	case OpCreateProxy:
+		record.Ports = append(record.Ports, "")
+		_, _, httpErr = m.startProxyServer(record.Name, record.Hostname, record.Ports[0], record.serverOptions())
+	case OpCreateHopper:
+		record.Ports = append(record.Ports, "", "")
+		_, _, _, httpErr = m.startHopperServer(record.Name, record.Hostname, record.Ports[0], record.Ports[1], record.serverOptions())
+	case OpCreateRoute:
+		target, err := parseTarget(record.Target)
+		if err != nil {
+			return URLParsingError
+		}
+		options := RouteOptions{}
+		if record.Options != nil {
+			options = *record.Options
+		}
+		httpErr = m.addProxyRedirect(record.Name, record.Route, target, options)
+	case OpAddHop:
+		if target, hop, httpErr := parseURLPair(record.Target, record.Hop); httpErr == nil {
+			options := HopOptions{}
+			if record.HopOptions != nil {
+				options = *record.HopOptions
+			}
+			return m.addHop(record.Name, target, hop, options, true)
+		}
+		httpErr = URLParsingError
+	case OpReceiveHop:
+		if target, hop, httpErr := parseURLPair(record.Target, record.Target); httpErr == nil {
+			return m.ReceiveHop(record.Name, target, hop)
+		}
+		httpErr = URLParsingError
+	case OpSetTLS:
+		if options := record.serverOptions(); options.TLS != nil {
+			_, httpErr = m.SetTLS(record.Name, *options.TLS)
+		}
+	case OpStopServer:
+		httpErr = m.stopServer(record.Name)
+	case OpStartServer:
+		httpErr = m.startServer(record.Name)
+	case OpRemoveServer:
+		httpErr = m.removeServer(record.Name)
+	case OpRemoveRoute:
+		conditions := RouteConditions{}
+		if record.Options != nil {
+			conditions = record.Options.RouteConditions
+		}
+		httpErr = m.removeProxyRedirect(record.Name, record.Route, conditions)
+	case OpRemoveHop, OpRemoveReceivedHop:
+		target, err := url.Parse(record.Target)
+		if err != nil {
+			return URLParsingError
+		}
+		if record.Op == OpRemoveHop {
+			httpErr = m.RemoveHop(record.Name, target)
+		} else {
+			httpErr = m.RemoveReceivedHop(record.Name, target)
+		}
+	default:
+		httpErr = &HttpError{ErrString: "Unknown journal operation " + record.Op, code: 500}
+	}
+	return
+}
+
+func parseURLPair(first, second string) (firstURL, secondURL *url.URL, httpErr *HttpError) {
+	var err error
+	if firstURL, err = url.Parse(first); err != nil {
+		httpErr = URLParsingError
+	} else if secondURL, err = url.Parse(second); err != nil {
+		httpErr = URLParsingError
+	}
+	return
+}
+
+func (m *MinihyperProxy) record(record StoreRecord) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.Append(record); err != nil {
+		m.ErrorLog.Printf("Could not journal %s %s: %v", record.Op, record.Name, err)
+	}
+}
+
+// mutation holds compactions off until the mutation calling it is
+// journaled, so that snapshots cover every record they drop. It returns the
+// function ending the mutation, which compacts the store if due.
+func (m *MinihyperProxy) mutation() (done func()) {
+	m.journaling.RLock()
+	return func() {
+		m.journaling.RUnlock()
+		m.compact()
+	}
+}
+
+func (m *MinihyperProxy) compact() {
+	if m.store == nil || !m.store.needsCompaction() {
+		return
+	}
+	m.journaling.Lock()
+	defer m.journaling.Unlock()
+	if !m.store.needsCompaction() {
+		return
+	}
+	if err := m.store.Compact(m.snapshotConfig()); err != nil {
+		m.ErrorLog.Printf("Could not compact state store: %v", err)
+	}
+}
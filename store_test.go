@@ -0,0 +1,249 @@
+package minihyperproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func storedRoutes(store *Store) (routes []RouteConfig) {
+	snapshot, records := store.State()
+	for _, p := range snapshot.Proxies {
+		routes = append(routes, p.Routes...)
+	}
+	for _, r := range records {
+		routes = append(routes, RouteConfig{Route: r.Route, Target: r.Target})
+	}
+	return
+}
+
+// TestStoreHelperProcess is not a real test: TestStoreRecoversFromKill runs
+// it in a child process that journals routes until it gets killed.
+func TestStoreHelperProcess(t *testing.T) {
+	dir := os.Getenv("MHP_STORE_HELPER_DIR")
+	if dir == "" {
+		return
+	}
+	store, err := OpenStore(dir)
+	if err != nil {
+		os.Exit(2)
+	}
+	config := &Config{Proxies: []ProxyConfig{{Name: "api", Routes: storedRoutes(store)}}}
+	for i := len(config.Proxies[0].Routes); ; i++ {
+		route := RouteConfig{Route: fmt.Sprintf("/r%d", i), Target: "http://localhost:9000"}
+		store.Append(StoreRecord{Op: OpCreateRoute, Name: "api", Route: route.Route, Target: route.Target})
+		config.Proxies[0].Routes = append(config.Proxies[0].Routes, route)
+		if i%25 == 24 {
+			store.Compact(config)
+		}
+	}
+}
+
+func TestStoreRecoversFromKill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mhp-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recovered := 0
+	for run := 0; run < 3; run++ {
+		cmd := exec.Command(os.Args[0], "-test.run=TestStoreHelperProcess")
+		cmd.Env = append(os.Environ(), "MHP_STORE_HELPER_DIR="+dir)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Duration(150+run*50) * time.Millisecond)
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		// Simulate a record torn halfway through on top of the kill.
+		journal, _ := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
+		journal.WriteString(`0badc0de {"Seq":99999,"Op":"CreateRo`)
+		journal.Close()
+
+		store, err := OpenStore(dir)
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		routes := storedRoutes(store)
+		store.Close()
+
+		if len(routes) <= recovered {
+			t.Fatalf("run %d: recovered %d routes, had %d before", run, len(routes), recovered)
+		}
+		for i, route := range routes {
+			if route.Route != fmt.Sprintf("/r%d", i) {
+				t.Fatalf("run %d: expected /r%d at position %d, got %s", run, i, i, route.Route)
+			}
+		}
+		recovered = len(routes)
+	}
+}
+
+func TestStoreReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mhp-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewMinihyperProxy()
+	if err := m.UseStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	m.store.CompactEvery = 3
+	m.startProxyServer("api", "", "", ServerOptions{})
+	m.addProxyRedirect("api", "/users", &url.URL{Scheme: "http", Host: "localhost:9000"}, RouteOptions{})
+	m.addProxyRedirect("api", "/orders", &url.URL{Scheme: "http", Host: "localhost:9001"}, RouteOptions{})
+	m.startHopperServer("edge", "", "", "", ServerOptions{})
+	m.AddHop("edge", &url.URL{Scheme: "http", Host: "www.example.com"}, &url.URL{Scheme: "http", Host: "localhost:7100"}, HopOptions{})
+	m.stopServer("edge")
+	m.stopServer("api")
+	m.store.Close()
+
+	restored := NewMinihyperProxy()
+	if err := restored.UseStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.store.Close()
+
+	if len(restored.Servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(restored.Servers))
+	}
+	proxyMap, _ := restored.GetProxyMap("api")
+	if len(proxyMap) != 2 {
+		t.Errorf("expected 2 routes, got %v", proxyMap)
+	}
+	hops, _ := restored.GetOutgoingHops("edge")
+	if len(hops) != 1 {
+		t.Errorf("expected 1 outgoing hop, got %v", hops)
+	}
+	if info, _ := restored.GetHopperInfo("edge"); (*info)["Status"] != "Down" {
+		t.Errorf("expected edge to stay stopped, got %v", (*info)["Status"])
+	}
+}
+
+func TestStoreCompactsOnCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mhp-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewMinihyperProxy()
+	if err := m.UseStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	m.store.CompactEvery = 1
+	m.startProxyServer("api", "", "", ServerOptions{})
+	m.startHopperServer("edge", "", "", "", ServerOptions{})
+	m.store.Close()
+	m.store = nil
+	m.removeServer("api")
+	m.removeServer("edge")
+
+	restored := NewMinihyperProxy()
+	if err := restored.UseStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.store.Close()
+	defer restored.removeServer("api")
+	defer restored.removeServer("edge")
+	if len(restored.Servers) != 2 {
+		t.Fatalf("expected the servers of the compacted records, got %d", len(restored.Servers))
+	}
+}
+
+func TestStoreCompactsConcurrentMutations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mhp-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewMinihyperProxy()
+	if err := m.UseStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	m.store.CompactEvery = 1
+	m.startProxyServer("api", "", "", ServerOptions{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.addProxyRedirect("api", fmt.Sprintf("/r%d", i), &url.URL{Scheme: "http", Host: "localhost:9000"}, RouteOptions{})
+		}(i)
+	}
+	wg.Wait()
+	m.store.Close()
+	m.store = nil
+	m.removeServer("api")
+
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if routes := storedRoutes(store); len(routes) != 50 {
+		t.Errorf("expected 50 stored routes, got %d", len(routes))
+	}
+}
+
+func TestStoreSkipsUnstartableServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mhp-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := NewMinihyperProxy()
+	if err := m.UseStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	m.store.CompactEvery = 1
+	apiPort, _, _ := m.startProxyServer("api", "", "", ServerOptions{})
+	m.startProxyServer("web", "", "", ServerOptions{})
+	m.store.Close()
+	m.store = nil
+	m.removeServer("api")
+	m.removeServer("web")
+
+	taken, err := net.Listen("tcp", "localhost:"+apiPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	restored := NewMinihyperProxy()
+	if err := restored.UseStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer restored.removeServer("web")
+	if _, ok := restored.server("web"); !ok || len(restored.Servers) != 1 {
+		t.Fatalf("expected web to be restored alone, got %v", restored.serverList())
+	}
+	if restored.store == nil {
+		t.Fatal("expected the store to be attached")
+	}
+	restored.addProxyRedirect("web", "/users", &url.URL{Scheme: "http", Host: "localhost:9000"}, RouteOptions{})
+	restored.store.Close()
+	restored.store = nil
+
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if routes := storedRoutes(store); len(routes) != 1 || routes[0].Route != "/users" {
+		t.Errorf("expected journaling to go on, got routes %v", routes)
+	}
+}
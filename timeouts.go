@@ -0,0 +1,207 @@
+package minihyperproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServerOptions are the settings of a ProxyServer or HopperServer beyond its
+// name and ports. Timeouts use Go syntax, as in "500ms" or "10s", and are
+// unlimited when left empty.
+type ServerOptions struct {
+	ReadHeaderTimeout string `json:"ReadHeaderTimeout,omitempty" yaml:"ReadHeaderTimeout,omitempty"`
+	ReadTimeout       string `json:"ReadTimeout,omitempty" yaml:"ReadTimeout,omitempty"`
+	WriteTimeout      string `json:"WriteTimeout,omitempty" yaml:"WriteTimeout,omitempty"`
+	IdleTimeout       string `json:"IdleTimeout,omitempty" yaml:"IdleTimeout,omitempty"`
+	// TunnelIdleTimeout closes upgraded connections, such as WebSockets, once
+	// idle.
+	TunnelIdleTimeout string `json:"TunnelIdleTimeout,omitempty" yaml:"TunnelIdleTimeout,omitempty"`
+	// Upstream applies to the routes and hops not overriding it.
+	Upstream *UpstreamOptions `json:"Upstream,omitempty" yaml:"Upstream,omitempty"`
+	// TLS is terminated by proxy listeners.
+	TLS *TLSOptions `json:"TLS,omitempty" yaml:"TLS,omitempty"`
+	// PeerTLS secures the hops between hoppers.
+	PeerTLS *PeerTLSOptions `json:"PeerTLS,omitempty" yaml:"PeerTLS,omitempty"`
+	// MaxHops is the most hoppers a request may go through, 16 by default.
+	MaxHops int `json:"MaxHops,omitempty" yaml:"MaxHops,omitempty"`
+	// HopSigning signs and verifies the hops between hoppers.
+	HopSigning *HopSigning `json:"HopSigning,omitempty" yaml:"HopSigning,omitempty"`
+	// RegistrationInterval is how often hops with Register are renewed on
+	// their remote hoppers, 30s by default.
+	RegistrationInterval string `json:"RegistrationInterval,omitempty" yaml:"RegistrationInterval,omitempty"`
+	// Mesh has the hopper discover its hops from the peers it gossips with.
+	Mesh *MeshOptions `json:"Mesh,omitempty" yaml:"Mesh,omitempty"`
+}
+
+// UpstreamOptions tune the connections to upstreams. RequestTimeout bounds a
+// whole request, retries included. TLS applies to https upstreams.
+type UpstreamOptions struct {
+	DialTimeout           string       `json:"DialTimeout,omitempty" yaml:"DialTimeout,omitempty"`
+	TLSHandshakeTimeout   string       `json:"TLSHandshakeTimeout,omitempty" yaml:"TLSHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout string       `json:"ResponseHeaderTimeout,omitempty" yaml:"ResponseHeaderTimeout,omitempty"`
+	RequestTimeout        string       `json:"RequestTimeout,omitempty" yaml:"RequestTimeout,omitempty"`
+	MaxIdleConnsPerHost   int          `json:"MaxIdleConnsPerHost,omitempty" yaml:"MaxIdleConnsPerHost,omitempty"`
+	TLS                   *UpstreamTLS `json:"TLS,omitempty" yaml:"TLS,omitempty"`
+}
+
+type serverSettings struct {
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	tunnelIdleTimeout time.Duration
+}
+
+type upstreamSettings struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	requestTimeout        time.Duration
+	maxIdleConnsPerHost   int
+	tlsConfig             *tls.Config
+}
+
+func (o ServerOptions) settings() (s *serverSettings, err error) {
+	s = &serverSettings{}
+	if s.readHeaderTimeout, err = parseDuration("ReadHeaderTimeout", o.ReadHeaderTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.readTimeout, err = parseDuration("ReadTimeout", o.ReadTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.writeTimeout, err = parseDuration("WriteTimeout", o.WriteTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.idleTimeout, err = parseDuration("IdleTimeout", o.IdleTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.tunnelIdleTimeout, err = parseDuration("TunnelIdleTimeout", o.TunnelIdleTimeout, 0); err != nil {
+		return nil, err
+	}
+	if o.Upstream != nil {
+		if _, err = o.Upstream.settings(); err != nil {
+			return nil, err
+		}
+	}
+	if o.TLS != nil {
+		if _, err = o.TLS.config(); err != nil {
+			return nil, err
+		}
+	}
+	if o.MaxHops < 0 {
+		return nil, fmt.Errorf("negative MaxHops")
+	}
+	if _, err = parseDuration("RegistrationInterval", o.RegistrationInterval, 0); err != nil {
+		return nil, err
+	}
+	if o.HopSigning != nil {
+		if _, err = o.HopSigning.settings(); err != nil {
+			return nil, err
+		}
+	}
+	if o.Mesh != nil {
+		if _, err = o.Mesh.settings(); err != nil {
+			return nil, err
+		}
+	}
+	if o.PeerTLS != nil {
+		_, _, err = o.PeerTLS.configs()
+	}
+	return
+}
+
+// hopperOnly fails if o sets an option only hoppers support.
+func (o ServerOptions) hopperOnly() error {
+	option := ""
+	switch {
+	case o.PeerTLS != nil:
+		option = "PeerTLS"
+	case o.HopSigning != nil:
+		option = "HopSigning"
+	case o.MaxHops != 0:
+		option = "MaxHops"
+	case o.RegistrationInterval != "":
+		option = "RegistrationInterval"
+	case o.Mesh != nil:
+		option = "Mesh"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s is only supported by hoppers", option)
+}
+
+func (o *UpstreamOptions) settings() (s *upstreamSettings, err error) {
+	s = &upstreamSettings{maxIdleConnsPerHost: o.MaxIdleConnsPerHost}
+	if s.dialTimeout, err = parseDuration("DialTimeout", o.DialTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.tlsHandshakeTimeout, err = parseDuration("TLSHandshakeTimeout", o.TLSHandshakeTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.responseHeaderTimeout, err = parseDuration("ResponseHeaderTimeout", o.ResponseHeaderTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.requestTimeout, err = parseDuration("RequestTimeout", o.RequestTimeout, 0); err != nil {
+		return nil, err
+	}
+	if s.maxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("negative MaxIdleConnsPerHost")
+	}
+	if o.TLS != nil {
+		if s.tlsConfig, err = o.TLS.config(); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// mergeUpstreamOptions overrides the fields of defaults set in overrides.
+func mergeUpstreamOptions(defaults *UpstreamOptions, overrides *UpstreamOptions) *UpstreamOptions {
+	if defaults == nil {
+		return overrides
+	}
+	merged := *defaults
+	if overrides != nil {
+		if overrides.DialTimeout != "" {
+			merged.DialTimeout = overrides.DialTimeout
+		}
+		if overrides.TLSHandshakeTimeout != "" {
+			merged.TLSHandshakeTimeout = overrides.TLSHandshakeTimeout
+		}
+		if overrides.ResponseHeaderTimeout != "" {
+			merged.ResponseHeaderTimeout = overrides.ResponseHeaderTimeout
+		}
+		if overrides.RequestTimeout != "" {
+			merged.RequestTimeout = overrides.RequestTimeout
+		}
+		if overrides.MaxIdleConnsPerHost != 0 {
+			merged.MaxIdleConnsPerHost = overrides.MaxIdleConnsPerHost
+		}
+		if overrides.TLS != nil {
+			merged.TLS = overrides.TLS
+		}
+	}
+	return &merged
+}
+
+// transport is http.DefaultTransport with the settings of s.
+func (s *upstreamSettings) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if s.dialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: s.dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if s.tlsHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = s.tlsHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = s.responseHeaderTimeout
+	if s.maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = s.maxIdleConnsPerHost
+	}
+	if s.tlsConfig != nil {
+		transport.TLSClientConfig = s.tlsConfig
+	}
+	return transport
+}
@@ -0,0 +1,88 @@
+package minihyperproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestServerTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	slowURL, _ := url.Parse(slow.URL)
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api", "ReadHeaderTimeout": "50ms", "Upstream": {"ResponseHeaderTimeout": "100ms", "MaxIdleConnsPerHost": 4}}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("create proxy: %d %s", resp.Code, resp.Body)
+	}
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+	if resp := callAPI(t, api, "POST", "/proxy", `{"Name": "bad", "IdleTimeout": "forever"}`); resp.Code != 422 {
+		t.Errorf("invalid timeout: expected 422, got %d", resp.Code)
+	}
+
+	for _, body := range []string{
+		`{"Name": "api", "Route": "/default", "Target": "` + slow.URL + `"}`,
+		`{"Name": "api", "Route": "/patient", "Target": "` + slow.URL + `", "Upstream": {"ResponseHeaderTimeout": "1s"}}`,
+		`{"Name": "api", "Route": "/bounded", "Target": "` + slow.URL + `", "Upstream": {"ResponseHeaderTimeout": "1s", "RequestTimeout": "50ms"}}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+			t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+		}
+	}
+
+	proxyURL := "http://localhost:" + created.Port
+	for path, expected := range map[string]int{"/default": http.StatusGatewayTimeout, "/patient": http.StatusOK, "/bounded": http.StatusGatewayTimeout} {
+		if status, _ := getBody(t, proxyURL+path); status != expected {
+			t.Errorf("%s: expected %d, got %d", path, expected, status)
+		}
+	}
+
+	conn, err := net.Dial("tcp", "localhost:"+created.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection without headers not closed by ReadHeaderTimeout: %v", err)
+	}
+
+	servers := ListServersResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy", `{"Name": "api"}`).Body.Bytes(), &servers)
+	if options, ok := (*servers.Info[0])["Options"].(map[string]interface{}); !ok || options["ReadHeaderTimeout"] != "50ms" {
+		t.Errorf("options not reported in server info: %+v", *servers.Info[0])
+	}
+
+	resp = callAPI(t, api, "POST", "/hopper", `{"Name": "edge", "Upstream": {"ResponseHeaderTimeout": "50ms"}}`)
+	hopper := CreateHopperResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &hopper)
+	defer m.removeServer("edge")
+	incomingPort, _, _, httpErr := m.startHopperServer("core", "", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("core")
+	m.AddHop("edge", slowURL, &url.URL{Scheme: "http", Host: "localhost:" + incomingPort}, HopOptions{})
+	m.ReceiveHop("core", slowURL, slowURL)
+	start := time.Now()
+	if status, _ := getBody(t, "http://localhost:"+hopper.OutgoingPort+"/"+slowURL.Hostname()+"/"); status != http.StatusBadGateway || time.Since(start) > 250*time.Millisecond {
+		t.Errorf("hop to a slow upstream: expected a quick 502, got %d after %v", status, time.Since(start))
+	}
+	for _, h := range m.ExportConfig().Hoppers {
+		if (h.Name == "edge") != (h.Upstream != nil) {
+			t.Errorf("hopper options not exported: %+v", h)
+		}
+	}
+}
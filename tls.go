@@ -0,0 +1,226 @@
+package minihyperproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+var errHopperTLS = fmt.Errorf("TLS is only supported by proxies")
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions terminate TLS on the listener of a server. The certificate is
+// picked by the SNI of the client among the names each one is valid for,
+// falling back to the first one. MinVersion defaults to 1.2. CipherSuites
+// restricts the TLS 1.2 and older suites, by their Go names, while TLS 1.3
+// suites are not configurable.
+type TLSOptions struct {
+	Certificates []TLSCertificate `json:"Certificates" yaml:"Certificates"`
+	MinVersion   string           `json:"MinVersion,omitempty" yaml:"MinVersion,omitempty"`
+	CipherSuites []string         `json:"CipherSuites,omitempty" yaml:"CipherSuites,omitempty"`
+}
+
+// TLSCertificate is a certificate chain and its key, either as paths of PEM
+// files or inline PEM.
+type TLSCertificate struct {
+	CertFile string `json:"CertFile,omitempty" yaml:"CertFile,omitempty"`
+	KeyFile  string `json:"KeyFile,omitempty" yaml:"KeyFile,omitempty"`
+	CertPEM  string `json:"CertPEM,omitempty" yaml:"CertPEM,omitempty"`
+	KeyPEM   string `json:"KeyPEM,omitempty" yaml:"KeyPEM,omitempty"`
+}
+
+type CertificateInfo struct {
+	Names    []string  `json:"Names"`
+	NotAfter time.Time `json:"NotAfter"`
+}
+
+func (c TLSCertificate) load() (cert tls.Certificate, err error) {
+	certPEM, keyPEM := []byte(c.CertPEM), []byte(c.KeyPEM)
+	if c.CertFile != "" {
+		if certPEM, err = ioutil.ReadFile(c.CertFile); err != nil {
+			return
+		}
+	}
+	if c.KeyFile != "" {
+		if keyPEM, err = ioutil.ReadFile(c.KeyFile); err != nil {
+			return
+		}
+	}
+	if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return
+}
+
+// loadCAPool reads a CA bundle from file, or inline PEM.
+func loadCAPool(file string, inline string) (pool *x509.CertPool, err error) {
+	caPEM := []byte(inline)
+	if file != "" {
+		if caPEM, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certificate found")
+	}
+	return
+}
+
+// config builds the tls.Config serving o, reading certificate files anew.
+func (o *TLSOptions) config() (*tls.Config, error) {
+	if len(o.Certificates) == 0 {
+		return nil, fmt.Errorf("TLS needs at least a certificate")
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.MinVersion != "" {
+		version, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown MinVersion %q, expected 1.0, 1.1, 1.2 or 1.3", o.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if len(o.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range o.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	for i, c := range o.Certificates {
+		cert, err := c.load()
+		if err != nil {
+			return nil, fmt.Errorf("certificate %d: %v", i+1, err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return config, nil
+}
+
+func certificatesInfo(config *tls.Config) []CertificateInfo {
+	infos := make([]CertificateInfo, 0, len(config.Certificates))
+	for _, cert := range config.Certificates {
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		infos = append(infos, CertificateInfo{Names: names, NotAfter: cert.Leaf.NotAfter})
+	}
+	return infos
+}
+
+func (c TLSCertificate) redacted() TLSCertificate {
+	if c.KeyPEM != "" {
+		c.KeyPEM = "REDACTED"
+	}
+	return c
+}
+
+func (o *UpstreamOptions) redacted() *UpstreamOptions {
+	if o == nil || o.TLS == nil || o.TLS.Certificate == nil {
+		return o
+	}
+	redactedTLS := *o.TLS
+	cert := o.TLS.Certificate.redacted()
+	redactedTLS.Certificate = &cert
+	redactedOptions := *o
+	redactedOptions.TLS = &redactedTLS
+	return &redactedOptions
+}
+
+// redacted hides the inline keys of o, for Info and ExportConfig.
+func (o ServerOptions) redacted() ServerOptions {
+	o.Upstream = o.Upstream.redacted()
+	if o.TLS != nil {
+		redactedTLS := *o.TLS
+		redactedTLS.Certificates = make([]TLSCertificate, len(o.TLS.Certificates))
+		for i, c := range o.TLS.Certificates {
+			redactedTLS.Certificates[i] = c.redacted()
+		}
+		o.TLS = &redactedTLS
+	}
+	if o.HopSigning != nil {
+		redactedSigning := *o.HopSigning
+		if redactedSigning.SharedKey != "" {
+			redactedSigning.SharedKey = "REDACTED"
+		}
+		if redactedSigning.PrivateKey != "" {
+			redactedSigning.PrivateKey = "REDACTED"
+		}
+		o.HopSigning = &redactedSigning
+	}
+	if o.PeerTLS != nil {
+		redactedPeerTLS := *o.PeerTLS
+		redactedPeerTLS.Certificate = o.PeerTLS.Certificate.redacted()
+		o.PeerTLS = &redactedPeerTLS
+	}
+	return o
+}
+
+// setTLS swaps the certificates and policy of a server created with TLS,
+// for the connections accepted from now on.
+func (s *ProxyServer) setTLS(options *TLSOptions) error {
+	config, err := options.config()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.options.TLS == nil {
+		return fmt.Errorf("server %s was not created with TLS", s.ServerName)
+	}
+	s.options.TLS = options
+	s.tlsConfig.Store(config)
+	s.infoLog.Printf("Swapped TLS certificates of %s", s.ServerName)
+	return nil
+}
+
+// UpstreamTLS verifies https upstreams against the CA bundle, as PEM file or
+// inline, instead of the system roots, expecting ServerName rather than the
+// host of the upstream when set. Certificate is presented to upstreams
+// requiring mutual TLS. InsecureSkipVerify disables verification altogether,
+// for lab environments only.
+type UpstreamTLS struct {
+	CAFile             string          `json:"CAFile,omitempty" yaml:"CAFile,omitempty"`
+	CAPEM              string          `json:"CAPEM,omitempty" yaml:"CAPEM,omitempty"`
+	Certificate        *TLSCertificate `json:"Certificate,omitempty" yaml:"Certificate,omitempty"`
+	ServerName         string          `json:"ServerName,omitempty" yaml:"ServerName,omitempty"`
+	InsecureSkipVerify bool            `json:"InsecureSkipVerify,omitempty" yaml:"InsecureSkipVerify,omitempty"`
+}
+
+func (o *UpstreamTLS) config() (config *tls.Config, err error) {
+	config = &tls.Config{ServerName: o.ServerName, InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" || o.CAPEM != "" {
+		if config.RootCAs, err = loadCAPool(o.CAFile, o.CAPEM); err != nil {
+			return nil, fmt.Errorf("upstream CA: %v", err)
+		}
+	}
+	if o.Certificate != nil {
+		cert, err := o.Certificate.load()
+		if err != nil {
+			return nil, fmt.Errorf("upstream certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+func (s *ProxyServer) currentTLSConfig() *tls.Config {
+	config, _ := s.tlsConfig.Load().(*tls.Config)
+	return config
+}
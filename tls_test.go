@@ -0,0 +1,261 @@
+package minihyperproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate self-signs a certificate valid for names, returning it
+// and its key as PEM.
+func newTestCertificate(t *testing.T, names ...string) (certPEM, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{SerialNumber: serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// testCA is a local certificate authority issuing certificates offline.
+type testCA struct {
+	cert  *x509.Certificate
+	key   *ecdsa.PrivateKey
+	CAPEM string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, CAPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue signs a certificate for name, also valid for localhost, usable by
+// both servers and clients.
+func (ca *testCA) issue(t *testing.T, name string) TLSCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{SerialNumber: serial,
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name, "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return TLSCertificate{CertPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))}
+}
+
+func jsonString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// tlsGet fetches url with SNI serverName, trusting only roots, and returns
+// the body along with the common name of the certificate served.
+func tlsGet(t *testing.T, url, serverName string, roots *x509.CertPool, maxVersion uint16) (string, string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: serverName, RootCAs: roots, MaxVersion: maxVersion}}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body), resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestProxyTLS(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	aCert, aKey := newTestCertificate(t, "a.test")
+	bCert, bKey := newTestCertificate(t, "b.test", "*.b.test")
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key")
+	ioutil.WriteFile(certFile, []byte(aCert), 0600)
+	ioutil.WriteFile(keyFile, []byte(aKey), 0600)
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	body := `{"Name": "secure", "TLS": {"MinVersion": "1.3", "Certificates": [{"CertFile": "` + certFile + `", "KeyFile": "` + keyFile + `"}, {"CertPEM": ` + jsonString(bCert) + `, "KeyPEM": ` + jsonString(bKey) + `}]}}`
+	resp := callAPI(t, api, "POST", "/proxy", body)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("create proxy: %d %s", resp.Code, resp.Body)
+	}
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("secure")
+	if resp := callAPI(t, api, "POST", "/proxy/route", `{"Name": "secure", "Route": "/", "Target": "`+upstream.URL+`"}`); resp.Code != http.StatusOK {
+		t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+	}
+
+	for _, bad := range []string{
+		`{"Name": "bad", "TLS": {"Certificates": [{"CertFile": "/nonexistent", "KeyFile": "/nonexistent"}]}}`,
+		`{"Name": "bad", "TLS": {"MinVersion": "0.9", "Certificates": [{"CertFile": "` + certFile + `", "KeyFile": "` + keyFile + `"}]}}`,
+		`{"Name": "bad", "TLS": {"CipherSuites": ["TLS_RSA_WITH_RC4_128_SHA"], "Certificates": [{"CertFile": "` + certFile + `", "KeyFile": "` + keyFile + `"}]}}`,
+	} {
+		if resp := callAPI(t, api, "POST", "/proxy", bad); resp.Code != 422 {
+			t.Errorf("expected 422 for %s, got %d", bad, resp.Code)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(aCert))
+	roots.AppendCertsFromPEM([]byte(bCert))
+	proxyURL := "https://localhost:" + created.Port + "/"
+	for serverName, expected := range map[string]string{"a.test": "a.test", "b.test": "b.test", "x.b.test": "b.test"} {
+		if body, name, err := tlsGet(t, proxyURL, serverName, roots, 0); err != nil || body != "ok" || name != expected {
+			t.Errorf("SNI %s: expected ok from %s, got %q from %q: %v", serverName, expected, body, name, err)
+		}
+	}
+	if _, _, err := tlsGet(t, proxyURL, "a.test", roots, tls.VersionTLS12); err == nil {
+		t.Errorf("TLS 1.2 accepted despite MinVersion 1.3")
+	}
+
+	servers := ListServersResponse{}
+	json.Unmarshal(callAPI(t, api, "GET", "/proxy", `{"Name": "secure"}`).Body.Bytes(), &servers)
+	if info, _ := json.Marshal(servers.Info[0]); strings.Contains(string(info), "PRIVATE KEY") || !strings.Contains(string(info), "Certificates") {
+		t.Errorf("server info leaks keys or misses certificates: %s", info)
+	}
+
+	cCert, cKey := newTestCertificate(t, "a.test", "c.test")
+	roots.AppendCertsFromPEM([]byte(cCert))
+	swap := `{"Name": "secure", "Certificates": [{"CertPEM": ` + jsonString(cCert) + `, "KeyPEM": ` + jsonString(cKey) + `}]}`
+	if resp := callAPI(t, api, "POST", "/proxy/tls", swap); resp.Code != http.StatusOK {
+		t.Fatalf("swap certificates: %d %s", resp.Code, resp.Body)
+	}
+	if body, _, err := tlsGet(t, proxyURL, "c.test", roots, tls.VersionTLS12); err != nil || body != "ok" {
+		t.Errorf("swapped certificate not served: %q %v", body, err)
+	}
+	if resp := callAPI(t, api, "POST", "/proxy/tls", `{"Name": "secure", "Certificates": []}`); resp.Code != 422 {
+		t.Errorf("empty swap: expected 422, got %d", resp.Code)
+	}
+	if exported := m.ExportConfig(); exported.Proxies[0].TLS == nil || exported.Proxies[0].TLS.Certificates[0].CertPEM != cCert {
+		t.Errorf("swapped certificates not exported")
+	}
+
+	callAPI(t, api, "POST", "/proxy", `{"Name": "plain"}`)
+	defer m.removeServer("plain")
+	if resp := callAPI(t, api, "POST", "/proxy/tls", strings.Replace(swap, "secure", "plain", 1)); resp.Code != 422 {
+		t.Errorf("swap on a plain proxy: expected 422, got %d", resp.Code)
+	}
+	if resp := callAPI(t, api, "POST", "/hopper", `{"Name": "hop", "TLS": {"Certificates": [{"CertPEM": `+jsonString(cCert)+`, "KeyPEM": `+jsonString(cKey)+`}]}}`); resp.Code != 422 {
+		t.Errorf("TLS on a hopper: expected 422, got %d", resp.Code)
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	ca := newTestCA(t, "backends")
+	serverCert, err := ca.issue(t, "backend").load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(ca.CAPEM))
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	m := NewMinihyperProxy()
+	api := BuildAPI(m)
+	resp := callAPI(t, api, "POST", "/proxy", `{"Name": "api"}`)
+	created := CreateProxyResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	defer m.removeServer("api")
+
+	client := ca.issue(t, "proxy")
+	certificate := `"Certificate": {"CertPEM": ` + jsonString(client.CertPEM) + `, "KeyPEM": ` + jsonString(client.KeyPEM) + `}`
+	trust := `"CAPEM": ` + jsonString(ca.CAPEM)
+	for route, expected := range map[string]int{
+		`"Route": "/default"`: http.StatusBadGateway,
+		`"Route": "/trusted", "Upstream": {"TLS": {` + trust + `}}`:                                              http.StatusBadGateway,
+		`"Route": "/mutual", "Upstream": {"TLS": {` + trust + `, ` + certificate + `}}`:                          http.StatusOK,
+		`"Route": "/named", "Upstream": {"TLS": {` + trust + `, ` + certificate + `, "ServerName": "backend"}}`:  http.StatusOK,
+		`"Route": "/misnamed", "Upstream": {"TLS": {` + trust + `, ` + certificate + `, "ServerName": "other"}}`: http.StatusBadGateway,
+		`"Route": "/insecure", "Upstream": {"TLS": {"InsecureSkipVerify": true, ` + certificate + `}}`:           http.StatusOK,
+	} {
+		body := `{"Name": "api", "Target": "` + upstream.URL + `", ` + route + `}`
+		if resp := callAPI(t, api, "POST", "/proxy/route", body); resp.Code != http.StatusOK {
+			t.Fatalf("create route: %d %s", resp.Code, resp.Body)
+		}
+		path := strings.Split(route, `"`)[3]
+		if status, _ := getBody(t, "http://localhost:"+created.Port+path); status != expected {
+			t.Errorf("%s: expected %d, got %d", path, expected, status)
+		}
+	}
+
+	if resp := callAPI(t, api, "POST", "/proxy/route", `{"Name": "api", "Route": "/bad", "Target": "`+upstream.URL+`", "Upstream": {"TLS": {"CAPEM": "nothing"}}}`); resp.Code != 422 {
+		t.Errorf("invalid CA: expected 422, got %d", resp.Code)
+	}
+	if routes := callAPI(t, api, "GET", "/proxy/route", `{"Name": "api"}`).Body.String(); strings.Contains(routes, "PRIVATE KEY") || !strings.Contains(routes, "REDACTED") {
+		t.Errorf("routes leak upstream keys: %s", routes)
+	}
+}
@@ -0,0 +1,72 @@
+package minihyperproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// isUpgrade tells whether r asks to switch protocols, as WebSockets do. The
+// connection then outlives the request, so request timeouts do not apply.
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != ""
+}
+
+// tunnelWriter hands out the connections it hijacks wrapped in an idleConn.
+type tunnelWriter struct {
+	http.ResponseWriter
+	idleTimeout time.Duration
+}
+
+func (w *tunnelWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &idleConn{Conn: conn, timeout: w.idleTimeout}, rw, nil
+}
+
+func (w *tunnelWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *tunnelWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idleConn fails reads and writes once no data went either way for timeout,
+// which tears the tunnel down.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// tunnel prepares w for an upgrade, closing the tunnel once idle for the
+// TunnelIdleTimeout of s.
+func (s *ProxyServer) tunnel(w http.ResponseWriter) http.ResponseWriter {
+	s.lock.RLock()
+	idleTimeout := s.tunnelIdle
+	s.lock.RUnlock()
+	if idleTimeout == 0 {
+		return w
+	}
+	return &tunnelWriter{ResponseWriter: w, idleTimeout: idleTimeout}
+}
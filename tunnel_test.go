@@ -0,0 +1,151 @@
+package minihyperproxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// readFrame reads a short WebSocket frame, unmasking its payload.
+func readFrame(r io.Reader) (opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	mask := make([]byte, 4)
+	if header[1]&0x80 != 0 {
+		if _, err = io.ReadFull(r, mask); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, header[1]&0x7f)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0f, payload, nil
+}
+
+func writeFrame(w io.Writer, opcode byte, payload []byte, masked bool) error {
+	frame := []byte{0x80 | opcode, byte(len(payload))}
+	if !masked {
+		frame = append(frame, payload...)
+	} else {
+		mask := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// newEchoWebSocketServer echoes the text frames of its WebSocket clients
+// until they close.
+func newEchoWebSocketServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "WebSocket expected", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + webSocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+		for {
+			opcode, payload, err := readFrame(rw)
+			if err != nil || opcode == 0x8 {
+				return
+			}
+			writeFrame(conn, opcode, append([]byte("echo: "), payload...), false)
+		}
+	}))
+}
+
+// dialWebSocket opens a WebSocket to path through the proxy at address.
+func dialWebSocket(t *testing.T, address, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	req, _ := http.NewRequest("GET", "http://"+address+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Write(conn)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		t.Fatalf("upgrade refused: %s %v", resp.Status, resp.Header)
+	}
+	return conn, reader
+}
+
+func TestWebSocketThroughHoppers(t *testing.T) {
+	echo := newEchoWebSocketServer(t)
+	defer echo.Close()
+	echoURL, _ := url.Parse(echo.URL)
+
+	m := NewMinihyperProxy()
+	_, edgeOutgoing, _, httpErr := m.startHopperServer("edge", "", "", "", ServerOptions{TunnelIdleTimeout: "200ms", Upstream: &UpstreamOptions{RequestTimeout: "50ms"}})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("edge")
+	coreIncoming, _, _, httpErr := m.startHopperServer("core", "", "", "", ServerOptions{})
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer m.removeServer("core")
+	m.AddHop("edge", echoURL, &url.URL{Scheme: "http", Host: "localhost:" + coreIncoming}, HopOptions{})
+	m.ReceiveHop("core", echoURL, echoURL)
+
+	conn, reader := dialWebSocket(t, "localhost:"+edgeOutgoing, "/"+echoURL.Hostname()+"/chat")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	// The tunnel outlives the RequestTimeout of the hopper while in use.
+	for _, message := range []string{"hello", "world"} {
+		time.Sleep(100 * time.Millisecond)
+		if err := writeFrame(conn, 0x1, []byte(message), true); err != nil {
+			t.Fatal(err)
+		}
+		if _, payload, err := readFrame(reader); err != nil || string(payload) != "echo: "+message {
+			t.Fatalf("expected an echo of %s, got %q: %v", message, payload, err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := reader.ReadByte(); err != io.EOF || time.Since(start) > time.Second {
+		t.Errorf("idle tunnel not closed after TunnelIdleTimeout: %v after %v", err, time.Since(start))
+	}
+}
@@ -21,13 +21,19 @@ type EmptyRequest struct {
 
 type ProxyMapResponse struct {
 	ProxyMap map[string]string `json:"ProxyMap"`
+	Routes   []RouteInfo       `json:"Routes"`
+}
+type HealthResponse struct {
+	Health map[string][]UpstreamStats `json:"Health"`
 }
 type GetServerRequest struct {
 	Name string `json:"Name"`
 }
 type CreateProxyRequest struct {
-	Name     string `json:"Name"`
-	Hostname string `json:"Hostname"`
+	Name          string `json:"Name"`
+	Hostname      string `json:"Hostname"`
+	Port          string `json:"Port"`
+	ServerOptions `mapstructure:",squash"`
 }
 
 type CreateProxyResponse struct {
@@ -36,17 +42,37 @@ type CreateProxyResponse struct {
 	Port     string `json:"Port"`
 }
 
+type SetTLSRequest struct {
+	Name       string `json:"Name"`
+	TLSOptions `mapstructure:",squash"`
+}
+
+type SetTLSResponse struct {
+	Name         string            `json:"Name"`
+	Certificates []CertificateInfo `json:"Certificates"`
+}
+
 type CreateRouteRequest struct {
-	Name   string `json:"Name"`
-	Route  string `json:"Route"`
-	Target string `json:"Target"`
+	Name         string `json:"Name"`
+	Route        string `json:"Route"`
+	Target       string `json:"Target"`
+	RouteOptions `mapstructure:",squash"`
 }
 
 type CreateRouteResponse CreateRouteRequest
 
+type DeleteRouteRequest struct {
+	Name            string `json:"Name"`
+	Route           string `json:"Route"`
+	RouteConditions `mapstructure:",squash"`
+}
+
 type CreateHopperRequest struct {
-	Name     string `json:"Name"`
-	Hostname string `json:"Hostname"`
+	Name          string `json:"Name"`
+	Hostname      string `json:"Hostname"`
+	IncomingPort  string `json:"IncomingPort"`
+	OutgoingPort  string `json:"OutgoingPort"`
+	ServerOptions `mapstructure:",squash"`
 }
 
 type CreateHopperResponse struct {
@@ -63,9 +89,15 @@ type CreateIncomingHopRequest struct {
 }
 
 type CreateOutgoingHopRequest struct {
-	Name   string `json:"Name"`
-	Route  string `json:"Route"`
-	Target string `json:"Target"`
+	Name       string `json:"Name"`
+	Route      string `json:"Route"`
+	Target     string `json:"Target"`
+	HopOptions `mapstructure:",squash"`
+}
+
+type DeleteHopRequest struct {
+	Name  string `json:"Name"`
+	Route string `json:"Route"`
 }
 
 type GetHopsRequest struct {
@@ -81,6 +113,11 @@ type GetOutgoingHopsResponse struct {
 }
 
 type GetHopsResponse struct {
-	IncomingHops map[string]*url.URL `json:"IncomingHops"`
-	OutgoingHops map[string]*url.URL `json:"OutgoingHops"`
+	IncomingHops map[string]*url.URL      `json:"IncomingHops"`
+	OutgoingHops map[string]*url.URL      `json:"OutgoingHops"`
+	Breakers     map[string]*BreakerStats `json:"Breakers,omitempty"`
+}
+
+type ReloadConfigRequest struct {
+	Path string `json:"Path"`
 }